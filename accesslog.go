@@ -0,0 +1,190 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 15:40:12
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 15:40:12
+ * @FilePath: /TinyRpcByGo/accesslog.go
+ */
+package tinyrpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//-------------------------------------------------------------------------------------
+// 访问日志和慢调用日志，用于事后排查问题
+// 访问日志每个请求写一条记录，慢调用日志只记录耗时超过阈值的请求，并可以附带截断后的参数
+
+type AccessLogFormat int
+
+const (
+	AccessLogJSON AccessLogFormat = iota // 每条记录一行 JSON
+	AccessLogText                        // 类似 common log format 的单行文本
+)
+
+type AccessRecord struct {
+	Time          time.Time         `json:"time"` // 收到请求的时间
+	RemoteAddr    string            `json:"remote_addr"`
+	ServiceMethod string            `json:"service_method"`
+	Seq           uint64            `json:"seq"`
+	ArgSize       int64             `json:"arg_size"`   // 请求体字节数
+	ReplySize     int64             `json:"reply_size"` // 响应字节数，包括响应头
+	Duration      time.Duration     `json:"-"`
+	Code          Code              `json:"code"`
+	Error         string            `json:"error,omitempty"`
+	Meta          map[string]string `json:"meta,omitempty"` // 请求头中的元数据，如 request-id
+	Args          string            `json:"args,omitempty"` // 只有慢调用日志会记录
+}
+
+func (r *AccessRecord) MarshalJSON() ([]byte, error) {
+	type alias AccessRecord
+	return json.Marshal(struct {
+		*alias
+		DurationMs float64 `json:"duration_ms"`
+	}{(*alias)(r), float64(r.Duration) / float64(time.Millisecond)})
+}
+
+// remote - - [time] "Service.Method" seq code arg_size reply_size duration k=v... "error"
+func (r *AccessRecord) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] %q %d %s %d %d %.3fms", r.RemoteAddr, r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.ServiceMethod, r.Seq, r.Code, r.ArgSize, r.ReplySize, float64(r.Duration)/float64(time.Millisecond))
+
+	keys := make([]string, 0, len(r.Meta))
+	for k := range r.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%q", k, r.Meta[k])
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, " %q", r.Error)
+	}
+	if r.Args != "" {
+		fmt.Fprintf(&b, " args=%q", r.Args)
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func (r *AccessRecord) encode(format AccessLogFormat) []byte {
+	if format == AccessLogText {
+		return []byte(r.text())
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil
+	}
+	return append(line, '\n')
+}
+
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format AccessLogFormat
+}
+
+func (l *accessLogger) write(r *AccessRecord) {
+	if l == nil {
+		return
+	}
+	line := r.encode(l.format)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+type slowLogger struct {
+	mu        sync.Mutex
+	w         io.Writer
+	threshold time.Duration
+	maxArgs   int // 参数 dump 的最大字节数，0 表示不记录参数
+}
+
+func (l *slowLogger) write(r *AccessRecord, req *request) {
+	if l == nil || r.Duration < l.threshold {
+		return
+	}
+	record := *r
+	if l.maxArgs > 0 && req.argv.IsValid() {
+		record.Args = truncate(fmt.Sprintf("%+v", req.argv.Interface()), l.maxArgs)
+	}
+	line := record.encode(AccessLogJSON)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "...(truncated)"
+}
+
+// 访问日志写到 w，每个请求一条记录，w 需要调用方自己关闭
+func WithAccessLog(w io.Writer, format AccessLogFormat) ServerOption {
+	return func(server *Server) {
+		server.accessLog = &accessLogger{w: w, format: format}
+	}
+}
+
+// 慢调用日志写到 w（JSON lines），耗时不小于 threshold 的请求才记录
+// maxArgs 大于 0 时附带参数的 dump，超过 maxArgs 字节的部分截断
+func WithSlowLog(w io.Writer, threshold time.Duration, maxArgs int) ServerOption {
+	return func(server *Server) {
+		server.slowLog = &slowLogger{w: w, threshold: threshold, maxArgs: maxArgs}
+	}
+}
+
+//-------------------------------------------------------------------------------------
+// 带计数的连接，读端包一层 bufio.Reader 并实现 io.ByteReader
+// gob 解码器遇到 ByteReader 不会再自己加缓冲，因此计数就是解码器实际消费的字节数
+
+type meteredConn struct {
+	io.ReadWriteCloser
+	r       *bufio.Reader
+	read    int64
+	written int64
+}
+
+func newMeteredConn(conn io.ReadWriteCloser) *meteredConn {
+	return &meteredConn{ReadWriteCloser: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		atomic.AddInt64(&c.read, 1)
+	}
+	return b, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) bytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+func (c *meteredConn) bytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
@@ -0,0 +1,98 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:56:45
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:56:45
+ * @FilePath: /TinyRpcByGo/cancel_test.go
+ */
+package tinyrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+	"tinyrpc/codec"
+)
+
+// 新版本的服务端在握手时声明支持取消帧
+func TestCancelFrameNegotiated(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(TraceFoo{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if !client.cancel {
+		t.Error("expect cancel frames to be negotiated with a new server")
+	}
+}
+
+// 旧版本的服务端原样返回 Option，调用超时后不能向它发送取消帧
+func TestNoCancelFrameToOldServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	methods := make(chan string, 4)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var opt Option
+		if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+			return
+		}
+		// 旧版本的 Option 没有 CancelFrame 字段
+		_ = json.NewEncoder(conn).Encode(struct {
+			MagicNumber int
+			CodecType   codec.Type
+		}{opt.MagicNumber, opt.CodecType})
+		cc := codec.NewGobCodec(conn)
+		for {
+			var h codec.Header
+			if err := cc.ReadHeader(&h); err != nil {
+				return
+			}
+			_ = cc.ReadBody(nil)
+			methods <- h.ServiceMethod // 不响应，让调用超时
+		}
+	}()
+
+	client, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.cancel {
+		t.Fatal("old server should not negotiate cancel frames")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var reply int
+	if err := client.Call(ctx, "TraceFoo.Sum", [2]int{1, 2}, &reply); err == nil {
+		t.Fatal("expect timeout")
+	}
+	if m := <-methods; m != "TraceFoo.Sum" {
+		t.Fatalf("first frame = %s", m)
+	}
+	select {
+	case m := <-methods:
+		t.Errorf("unexpected frame %s sent to old server", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
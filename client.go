@@ -14,13 +14,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 	"tinyrpc/codec"
+	"tinyrpc/trace"
 )
 
 type Call struct {
@@ -30,6 +31,7 @@ type Call struct {
 	Reply         interface{}
 	Error         error
 	Done          chan *Call
+	Meta          map[string]string // 随请求头发送的元数据
 }
 
 func (call *Call) done() {
@@ -46,6 +48,12 @@ type Client struct {
 	pending  map[uint64]*Call // 存储未处理完的请求，key 编号seq，val是Call实例,类似消息队列
 	closing  bool             // 手动关闭
 	shutdown bool             // 由于错误的关闭
+	addr     string           // 服务端地址，用于日志
+	cancel   bool             // 服务端是否支持取消帧，握手时协商
+}
+
+func (client *Client) log() *slog.Logger {
+	return client.opt.logger()
 }
 
 func (client *Client) IsAvailable() bool {
@@ -54,9 +62,16 @@ func (client *Client) IsAvailable() bool {
 	return !client.shutdown && !client.closing
 }
 
+// 还未收到响应的请求数，负载均衡据此判断连接的繁忙程度
+func (client *Client) Pending() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending)
+}
+
 var _ io.Closer = (*Client)(nil)
 
-var ErrShutdown = errors.New("connection is shutdwon")
+var ErrShutdown error = newError(CodeUnavailable, "connection is shutdwon")
 
 func (client *Client) Close() error {
 	client.mu.Lock()
@@ -132,21 +147,31 @@ func (client *Client) receive() {
 			// call不存在
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			// 存在但服务端处理报错了
-			call.Error = fmt.Errorf(h.Error)
+			// 存在但服务端处理报错了，还原出服务端给的错误码
+			code := Code(h.Code)
+			if code == "" {
+				code = CodeUnknown
+			}
+			call.Error = newError(code, h.Error)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
 			//call存在且被正确处理，就解析body拿出结果
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body" + err.Error())
+				call.Error = newError(CodeInvalidArgument, "reading body"+err.Error())
 			}
 			call.done()
 		}
 	}
 
 	// 发生错误了直接终止
+	client.mu.Lock()
+	closing := client.closing
+	client.mu.Unlock()
+	if !closing {
+		client.log().Warn("rpc client: connection terminated", "remote_addr", client.addr, "err", err)
+	}
 	client.terminalCalls(err)
 }
 
@@ -161,28 +186,35 @@ func NewClient(conn net.Conn, opt *Option) (*Client, error) {
 		return nil, err
 	}
 
+	addr := conn.RemoteAddr().String()
+
 	// send opt with server
 	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc client: options error", err)
+		opt.logger().Error("rpc client: send options error", "remote_addr", addr, "err", err)
 		_ = conn.Close()
 		return nil, err
 	}
 	//接收一个服务端发来的响应，说明解析完了opt，然后再发送请求消息，防止粘包
-	if err := json.NewDecoder(conn).Decode(opt); err != nil {
-		log.Println("rpc client: option err: ", err)
+	//解码到副本中，opt 可能是多个连接共用的 DefaultOption
+	var echo Option
+	if err := json.NewDecoder(conn).Decode(&echo); err != nil {
+		opt.logger().Error("rpc client: receive options error", "remote_addr", addr, "err", err)
 		_ = conn.Close()
 		return nil, err
 	}
 
-	return newClientCodec(f(conn), opt), nil
+	client := newClientCodec(f(conn), opt, addr)
+	client.cancel = echo.CancelFrame
+	return client, nil
 }
 
-func newClientCodec(cc codec.Codec, opt *Option) *Client {
+func newClientCodec(cc codec.Codec, opt *Option, addr string) *Client {
 	client := &Client{
 		cc:      cc,
 		opt:     opt,
 		seq:     1,
 		pending: make(map[uint64]*Call),
+		addr:    addr,
 	}
 	go client.receive() // 每开一个实例就起一个receive协程去接收响应
 	return client
@@ -190,7 +222,7 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
 
 // 封装一下传进来的opt可选项参数
 func parseOption(opts ...*Option) (*Option, error) {
-	if len(opts) == 0 || len(opts) == 1 {
+	if len(opts) == 0 || (len(opts) == 1 && opts[0] == nil) {
 		return DefaultOption, nil
 	}
 	if len(opts) > 1 {
@@ -250,7 +282,7 @@ func dialTimeout(f newClientFunc, network string, address string, opts ...*Optio
 
 	select {
 	case <-time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+		return nil, newError(CodeUnavailable, fmt.Sprintf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout))
 	case result := <-ch:
 		return result.client, result.err
 	}
@@ -299,6 +331,7 @@ func (client *Client) send(call *Call) {
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Error = ""
 	client.header.Seq = call.Seq
+	client.header.Meta = call.Meta
 
 	// 编码并发送请求
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
@@ -312,12 +345,35 @@ func (client *Client) send(call *Call) {
 	}
 }
 
+// 调用方放弃了还没有收到响应的请求，通知服务端取消处理函数的 ctx，服务端不会响应取消帧
+// 旧版本的服务端不认识取消帧，会把它当作一个找不到服务的请求，打乱连接上的数据流，握手时没有协商到时不发送
+func (client *Client) sendCancel(seq uint64) {
+	if !client.cancel {
+		return
+	}
+	client.sendLock.Lock()
+	defer client.sendLock.Unlock()
+	if !client.IsAvailable() {
+		return
+	}
+	h := codec.Header{ServiceMethod: CancelServiceMethod, Seq: seq}
+	if err := client.cc.Write(&h, invalidRequest); err != nil {
+		client.log().Debug("rpc client: send cancel error", "seq", seq, "remote_addr", client.addr, "err", err)
+	}
+}
+
 //异步接口，返回Call的实例
 func (client *Client) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	return client.goContext(context.Background(), serviceMethod, args, reply, done)
+}
+
+// 从 ctx 中取出元数据和链路信息放进请求头，服务端据此创建子 span
+func (client *Client) goContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
-		log.Panic("rpc client: done channel is unbuffered")
+		// 调用方的编程错误，与 net/rpc 一致直接 panic
+		panic("rpc client: done channel is unbuffered")
 	}
 
 	call := &Call{
@@ -327,21 +383,54 @@ func (client *Client) Go(serviceMethod string, args interface{}, reply interface
 		Done:          done,
 	}
 
+	meta := make(map[string]string)
+	for k, v := range metadata(ctx) {
+		meta[k] = v
+	}
+	trace.Inject(ctx, meta)
+	if len(meta) > 0 {
+		call.Meta = meta
+	}
+
 	client.send(call)
 	return call
 }
 
 //同步接口，receive() 后说明调用结束，调用done(), 此时会将调用好的call放进信道Done
+// 设置了 Option.Retry 时按重试策略重试，每次尝试都是一次独立的调用
+// Client 不会重连，连接断开后每次尝试都会返回 ErrShutdown，此时不再重试
+// 需要在连接断开后重试时使用 XClient，它会重新拨号或者换一个实例
 func (client *Client) Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	if client.opt.Retry == nil {
+		return client.call(ctx, serviceMethod, args, reply)
+	}
+	policy := client.opt.Retry.ForMethod(serviceMethod)
+	retryable := func(err error) bool {
+		return client.IsAvailable() && policy.Retryable(err)
+	}
+	return policy.Do(ctx, retryable, func(ctx context.Context, attempt int) error {
+		return client.call(ctx, serviceMethod, args, reply)
+	})
+}
+
+func (client *Client) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
 	//call := <-client.Go(serviceMethod, args, reply, make(chan *Call, 1)).Done
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	start := time.Now()
+	call := client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1))
+	var err error
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		if client.removeCall(call.Seq) != nil {
+			client.sendCancel(call.Seq)
+		}
+		err = fmt.Errorf("rpc client: call failed: %w", ctx.Err())
 	case ca := <-call.Done:
-		return ca.Error
+		err = ca.Error
 	}
+	client.log().Debug("rpc client: call done", "service_method", serviceMethod, "seq", call.Seq,
+		"remote_addr", client.addr, "attempt", parseAttempt(metadata(ctx)), "latency", time.Since(start),
+		"code", ErrorCode(err), "err", err)
+	return err
 
 	//用户可以使用创建有超时检测功能的context对象来控制
 	//ctx, _ := context.WithTimeout(context.Background(), time.Second)
@@ -372,6 +461,19 @@ func DialHTTP(network string, address string, opts ...*Option) (*Client, error)
 	return dialTimeout(NewHTTPclient, network, address, opts...)
 }
 
+// 统一服务实例的地址格式，返回 XDial 使用的 protocol@addr 和其中的 protocol
+// addr 已经带了 protocol@ 时以 addr 中的为准，否则把 protocol 补在前面，protocol 为空时原样返回
+// 注册中心保存服务实例时和服务发现拿到实例时都使用它，保证两边的地址格式一致
+func NormalizeAddr(addr string, protocol string) (string, string) {
+	if i := strings.Index(addr, "@"); i >= 0 {
+		return addr, addr[:i]
+	}
+	if protocol != "" {
+		return protocol + "@" + addr, protocol
+	}
+	return addr, protocol
+}
+
 //http和rpc统一的api
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
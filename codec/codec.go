@@ -20,9 +20,11 @@ import "io"
 
 */
 type Header struct {
-	ServiceMethod string // 格式 "Service.Method"
-	Seq           uint64 // 请求序号，某个请求的id，用来区分不同的请求
-	Error         string // 错误号， 客户端置为空，服务端若发生错误将错误放进去
+	ServiceMethod string            // 格式 "Service.Method"
+	Seq           uint64            // 请求序号，某个请求的id，用来区分不同的请求
+	Error         string            // 错误号， 客户端置为空，服务端若发生错误将错误放进去
+	Code          string            // 错误码，与 Error 一起由服务端设置
+	Meta          map[string]string // 随请求传递的元数据，如链路追踪的 traceparent
 }
 
 type Codec interface { // 抽象出对消息体编解码的接口Codec， 目的是实现不同的CodeC实例
@@ -11,7 +11,6 @@ import (
 	"bufio"
 	"encoding/gob"
 	"io"
-	"log"
 )
 
 type GobCodec struct {
@@ -53,13 +52,12 @@ func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 		}
 	}()
 
+	// 编码错误直接返回，由调用方带上请求信息记录日志
 	if err = c.enc.Encode(h); err != nil {
-		log.Println("rpc codec: gob error encoding header", err)
 		return
 	}
 
 	if err = c.enc.Encode(body); err != nil {
-		log.Println("rpc codec: gob error encoding Body", err)
 		return
 	}
 
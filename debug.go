@@ -9,57 +9,397 @@
 package tinyrpc
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const debugText = `<html>
 	<body>
-	<title>GeeRPC Services</title>
-	{{range .}}
+	<title>TinyRPC Services</title>
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
-		{{range $name, $mtype := .Method}}
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th>
+		<th align=center>p50</th><th align=center>p90</th><th align=center>p99</th>
+		{{range .Methods}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
-			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=left font=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{.Errors}}</td>
+			<td align=center>{{.P50}}</td>
+			<td align=center>{{.P90}}</td>
+			<td align=center>{{.P99}}</td>
 			</tr>
 		{{end}}
 		</table>
 	{{end}}
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>ID</th><th align=center>Remote</th><th align=center>Codec</th>
+		<th align=center>In-flight</th><th align=center>Age</th>
+		{{range .Conns}}
+			<tr>
+			<td align=center>{{.ID}}</td>
+			<td align=left>{{.RemoteAddr}}</td>
+			<td align=left>{{.Codec}}</td>
+			<td align=center>{{.InFlight}}</td>
+			<td align=center>{{.Age}}</td>
+			</tr>
+		{{end}}
+		</table>
+	<hr>
+	In-flight requests
+	<hr>
+		<table>
+		<th align=center>Conn</th><th align=center>Seq</th><th align=center>Method</th>
+		<th align=center>Remote</th><th align=center>Start</th><th align=center>Elapsed</th><th align=center>Responded</th>
+		{{range .InFlight}}
+			<tr>
+			<td align=center>{{.ConnID}}</td>
+			<td align=center>{{.Seq}}</td>
+			<td align=left>{{.ServiceMethod}}</td>
+			<td align=left>{{.RemoteAddr}}</td>
+			<td align=left>{{.Start.Format "2006-01-02 15:04:05.000"}}</td>
+			<td align=center>{{.Elapsed}}</td>
+			<td align=center>{{.Responded}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{range .Sections}}
+	<hr>
+	{{.Name}}
+	<hr>
+	<pre>{{.JSON}}</pre>
+	{{end}}
 	</body>
 	</html>`
 
 var debug = template.Must(template.New("RPC debug").Parse(debugText))
 
+const inflightText = `<html>
+	<body>
+	<title>TinyRPC In-flight Requests</title>
+	<hr>
+	In-flight requests
+	<hr>
+		<table>
+		<th align=center>Conn</th><th align=center>Seq</th><th align=center>Method</th>
+		<th align=center>Remote</th><th align=center>Start</th><th align=center>Elapsed</th><th align=center>Responded</th><th></th>
+		{{range .InFlight}}
+			<tr>
+			<td align=center>{{.ConnID}}</td>
+			<td align=center>{{.Seq}}</td>
+			<td align=left>{{.ServiceMethod}}</td>
+			<td align=left>{{.RemoteAddr}}</td>
+			<td align=left>{{.Start.Format "2006-01-02 15:04:05.000"}}</td>
+			<td align=center>{{.Elapsed}}</td>
+			<td align=center>{{.Responded}}</td>
+			<td><form method=post><input type=hidden name=action value=cancel><input type=hidden name=conn value={{.ConnID}}><input type=hidden name=seq value={{.Seq}}><input type=submit value=cancel></form></td>
+			</tr>
+		{{end}}
+		</table>
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>ID</th><th align=center>Remote</th><th align=center>In-flight</th><th align=center>Age</th><th></th>
+		{{range .Conns}}
+			<tr>
+			<td align=center>{{.ID}}</td>
+			<td align=left>{{.RemoteAddr}}</td>
+			<td align=center>{{.InFlight}}</td>
+			<td align=center>{{.Age}}</td>
+			<td><form method=post><input type=hidden name=action value=close><input type=hidden name=conn value={{.ID}}><input type=submit value=close></form></td>
+			</tr>
+		{{end}}
+		</table>
+	</body>
+	</html>`
+
+var inflight = template.Must(template.New("RPC inflight").Parse(inflightText))
+
 type debugHTTP struct {
 	*Server
 }
 
+// 调试页面的数据，HTML 和 JSON 共用
+type debugInfo struct {
+	Services []debugService `json:"services"`
+	Conns    []debugConn    `json:"conns"`
+	InFlight []debugRequest `json:"in_flight"`
+	Sections []debugSection `json:"sections"`
+}
+
 type debugService struct {
-	Name   string
-	Method map[string]*methodType
+	Name    string        `json:"name"`
+	Methods []debugMethod `json:"methods"`
 }
 
-// Runs at /debug/geerpc
-func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// Build a sorted version of the data.
-	var services []debugService
+type debugMethod struct {
+	Name      string        `json:"name"`
+	ArgType   string        `json:"arg_type"`
+	ReplyType string        `json:"reply_type"`
+	Calls     uint64        `json:"calls"`
+	Errors    uint64        `json:"errors"`
+	P50       debugDuration `json:"p50_ms"`
+	P90       debugDuration `json:"p90_ms"`
+	P99       debugDuration `json:"p99_ms"`
+}
+
+type debugConn struct {
+	ID         uint64        `json:"id"`
+	RemoteAddr string        `json:"remote_addr"`
+	Codec      string        `json:"codec"`
+	InFlight   int           `json:"in_flight"`
+	Start      time.Time     `json:"start"`
+	Age        debugDuration `json:"age_ms"`
+}
+
+type debugRequest struct {
+	ConnID        uint64        `json:"conn_id"`
+	Seq           uint64        `json:"seq"`
+	ServiceMethod string        `json:"service_method"`
+	RemoteAddr    string        `json:"remote_addr"`
+	Start         time.Time     `json:"start"`
+	Elapsed       debugDuration `json:"elapsed_ms"`
+	Responded     bool          `json:"responded"` // 超时后已经响应，但处理函数还没返回
+}
+
+// HTML 中按 time.Duration 显示，JSON 中为毫秒数
+type debugDuration time.Duration
+
+func (d debugDuration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d debugDuration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)), nil
+}
+
+func (server *Server) debugInfo() *debugInfo {
+	info := &debugInfo{}
+	now := time.Now()
+
 	server.serviceMap.Range(func(namei, svci interface{}) bool {
 		svc := svci.(*service)
-		services = append(services, debugService{
-			Name:   namei.(string),
-			Method: svc.method,
+		ds := debugService{Name: namei.(string)}
+		for name, m := range svc.method {
+			ds.Methods = append(ds.Methods, debugMethod{
+				Name:      name,
+				ArgType:   m.ArgType.String(),
+				ReplyType: m.ReplyType.String(),
+				Calls:     m.NumCalls(),
+				Errors:    m.NumErrors(),
+				P50:       debugDuration(m.latency.Quantile(0.5)),
+				P90:       debugDuration(m.latency.Quantile(0.9)),
+				P99:       debugDuration(m.latency.Quantile(0.99)),
+			})
+		}
+		sort.Slice(ds.Methods, func(i, j int) bool { return ds.Methods[i].Name < ds.Methods[j].Name })
+		info.Services = append(info.Services, ds)
+		return true
+	})
+	sort.Slice(info.Services, func(i, j int) bool { return info.Services[i].Name < info.Services[j].Name })
+
+	server.mu.Lock()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for _, sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	for _, sc := range conns {
+		sc.mu.Lock()
+		info.Conns = append(info.Conns, debugConn{
+			ID:         sc.id,
+			RemoteAddr: sc.remoteAddr,
+			Codec:      string(sc.codecType),
+			InFlight:   len(sc.requests),
+			Start:      sc.start,
+			Age:        debugDuration(now.Sub(sc.start)),
 		})
+		for _, req := range sc.requests {
+			info.InFlight = append(info.InFlight, debugRequest{
+				ConnID:        sc.id,
+				Seq:           req.h.Seq,
+				ServiceMethod: req.h.ServiceMethod,
+				RemoteAddr:    sc.remoteAddr,
+				Start:         req.start,
+				Elapsed:       debugDuration(now.Sub(req.start)),
+				Responded:     atomic.LoadInt32(&req.responded) == 1,
+			})
+		}
+		sc.mu.Unlock()
+	}
+	sort.Slice(info.InFlight, func(i, j int) bool { return info.InFlight[i].Start.Before(info.InFlight[j].Start) })
+
+	info.Sections = collectDebugSections()
+	return info
+}
+
+//-------------------------------------------------------------------------------------
+// 调试页面的扩展，进程内的其他组件（比如 xclient 的熔断器）可以在调试页面上展示自己的状态
+// fn 在每次访问调试页面时调用，返回值需要能编码为 JSON
+
+var debugSections sync.Map // name -> func() interface{}
+
+func RegisterDebugSection(name string, fn func() interface{}) {
+	debugSections.Store(name, fn)
+}
+
+func UnregisterDebugSection(name string) {
+	debugSections.Delete(name)
+}
+
+type debugSection struct {
+	Name string      `json:"name"`
+	Data interface{} `json:"data"`
+}
+
+// HTML 页面中直接展示 JSON
+func (s debugSection) JSON() string {
+	b, err := json.MarshalIndent(s.Data, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+func collectDebugSections() []debugSection {
+	sections := make([]debugSection, 0)
+	debugSections.Range(func(name, fn interface{}) bool {
+		sections = append(sections, debugSection{Name: name.(string), Data: fn.(func() interface{})()})
 		return true
 	})
-	err := debug.Execute(w, services)
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Name < sections[j].Name })
+	return sections
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, "rpc: error encoding json: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Runs at /debug/tinyrpc，加上 ?format=json 返回 JSON
+func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Build a sorted version of the data.
+	info := server.debugInfo()
+
+	if req.URL.Query().Get("format") == "json" {
+		writeJSON(w, info)
+		return
+	}
+
+	err := debug.Execute(w, info)
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
 }
 
+//-------------------------------------------------------------------------------------
+// 正在执行的请求的查看和干预，处理函数卡住时不用再去翻 goroutine dump
+// GET  列出所有连接上正在执行的请求，?format=json 返回 JSON
+// POST action=cancel&conn=ID&seq=N 取消一个请求，action=close&conn=ID 关闭一个连接
+// 这是运维接口，通过 HandleInflight 单独开启，不要暴露在公网上
+// POST 会修改服务端的状态，浏览器从其他站点发来的请求（Origin 或 Sec-Fetch-Site 不是本站）一律拒绝，避免跨站请求伪造
+
+type inflightHTTP struct {
+	*Server
+}
+
+type inflightInfo struct {
+	InFlight []debugRequest `json:"in_flight"`
+	Conns    []debugConn    `json:"conns"`
+}
+
+// Runs at /debug/tinyrpc/inflight
+func (server inflightHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	asJSON := req.URL.Query().Get("format") == "json"
+
+	switch req.Method {
+	case "GET":
+		info := server.debugInfo()
+		data := &inflightInfo{InFlight: info.InFlight, Conns: info.Conns}
+		if asJSON {
+			writeJSON(w, data)
+			return
+		}
+		if err := inflight.Execute(w, data); err != nil {
+			_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+		}
+	case "POST":
+		if !sameOrigin(req) {
+			server.log().Warn("rpc server: reject cross-site inflight request", "origin", req.Header.Get("Origin"), "admin_addr", req.RemoteAddr)
+			http.Error(w, "rpc: cross-site request rejected", http.StatusForbidden)
+			return
+		}
+		action := req.FormValue("action")
+		connID, err := strconv.ParseUint(req.FormValue("conn"), 10, 64)
+		if err != nil {
+			http.Error(w, "rpc: invalid conn id", http.StatusBadRequest)
+			return
+		}
+
+		var ok bool
+		switch action {
+		case "cancel":
+			seq, err := strconv.ParseUint(req.FormValue("seq"), 10, 64)
+			if err != nil {
+				http.Error(w, "rpc: invalid seq", http.StatusBadRequest)
+				return
+			}
+			ok = server.cancelRequest(connID, seq)
+			server.log().Info("rpc server: cancel request from admin", "conn_id", connID, "seq", seq, "found", ok, "admin_addr", req.RemoteAddr)
+		case "close":
+			ok = server.closeConn(connID)
+			server.log().Info("rpc server: close connection from admin", "conn_id", connID, "found", ok, "admin_addr", req.RemoteAddr)
+		default:
+			http.Error(w, "rpc: unknown action "+action, http.StatusBadRequest)
+			return
+		}
+
+		if !ok {
+			http.Error(w, "rpc: request or connection not found", http.StatusNotFound)
+			return
+		}
+		if asJSON {
+			writeJSON(w, map[string]bool{"ok": true})
+			return
+		}
+		http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// 请求是否来自本站的页面，curl 等非浏览器的客户端不带这两个请求头，允许
+func sameOrigin(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
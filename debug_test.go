@@ -0,0 +1,51 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 03:00:59
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 03:00:59
+ * @FilePath: /TinyRpcByGo/debug_test.go
+ */
+package tinyrpc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// 其他站点的页面发来的 POST 被拒绝，本站页面和非浏览器客户端的请求正常处理
+func TestInflightRejectsCrossSitePost(t *testing.T) {
+	h := inflightHTTP{NewServer()}
+	form := url.Values{"action": {"close"}, "conn": {"1"}}.Encode()
+	post := func(header map[string]string) int {
+		req := httptest.NewRequest("POST", "http://admin.local/debug/tinyrpc/inflight", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, header := range []map[string]string{
+		{"Origin": "http://evil.example"},
+		{"Origin": "null"},
+		{"Sec-Fetch-Site": "cross-site"},
+	} {
+		if code := post(header); code != http.StatusForbidden {
+			t.Errorf("%v: status = %d, want 403", header, code)
+		}
+	}
+	// 连接不存在，通过了来源检查
+	for _, header := range []map[string]string{
+		nil,
+		{"Origin": "http://admin.local", "Sec-Fetch-Site": "same-origin"},
+	} {
+		if code := post(header); code != http.StatusNotFound {
+			t.Errorf("%v: status = %d, want 404", header, code)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 14:03:26
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 14:03:26
+ * @FilePath: /TinyRpcByGo/errors.go
+ */
+package tinyrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// 错误码，服务端写在响应头 Header.Code 中返回，客户端据此还原出 *Error
+// 日志、重试等逻辑都只看错误码，不去解析错误信息的字符串
+type Code string
+
+const (
+	CodeOK               Code = "ok"
+	CodeCanceled         Code = "canceled"          // 调用被取消
+	CodeDeadlineExceeded Code = "deadline_exceeded" // 调用超时
+	CodeNotFound         Code = "not_found"         // 服务或方法不存在
+	CodeInvalidArgument  Code = "invalid_argument"  // 请求格式错误，请求体无法解码
+	CodeUnavailable      Code = "unavailable"       // 连接不可用，拨号失败或连接已断开
+	CodeInternal         Code = "internal"          // 服务端处理函数返回了错误
+	CodeUnknown          Code = "unknown"
+)
+
+type Error struct {
+	Code Code
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func newError(code Code, msg string) *Error {
+	return &Error{Code: code, Msg: msg}
+}
+
+// 返回错误对应的错误码，nil 为 CodeOK
+func ErrorCode(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return CodeUnavailable
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return CodeUnavailable
+	}
+	return CodeUnknown
+}
@@ -249,7 +249,7 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	l, _ := net.Listen("tcp", ":0")
 	server := tinyrpc.NewServer()
 	_ = server.Register(&foo)
-	registry.Heartbeat(registryAddr, "tcp@"+l.Addr().String(), 0)
+	registry.Heartbeat(registryAddr, "", "tcp@"+l.Addr().String(), 0)
 	wg.Done()
 	server.Accept(l)
 }
@@ -339,12 +339,12 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	listener, _ := net.Listen("tcp", ":0")
 	server := tinyrpc.NewServer()
 	server.Register(new(Foo))
-	//registry.Heartbeat(registryAddr, "tcp@" + listener.Addr().String(), 0)
+	//registry.Heartbeat(registryAddr, "Foo", "tcp@" + listener.Addr().String(), 0)
 	//registry.PutZkServer(listener.Addr().String())
 
 	etcd := registry.NewEtcdClient([]string{registryAddr}, 5*time.Second)
 	defer etcd.Close()
-	etcd.PutServer("tcp@" + listener.Addr().String())
+	etcd.PutServer("Foo", "tcp@"+listener.Addr().String())
 
 	wg.Done()
 
@@ -393,7 +393,8 @@ func broadcast(registry string) {
 				Num2: i * i,
 			}
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", args)
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
 		}(i)
 	}
@@ -0,0 +1,71 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 15:21:48
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 15:21:48
+ * @FilePath: /TinyRpcByGo/metadata.go
+ */
+package tinyrpc
+
+import (
+	"context"
+	"tinyrpc/trace"
+)
+
+// 元数据随请求头 Header.Meta 发送，服务端记录在访问日志中，并放进处理函数的 ctx 继续向下游透传
+const RequestIDKey = "request-id"
+
+type metadataKey struct{}
+
+// 返回附加了元数据的 ctx，kv 按 key, value 成对传入，通过这个 ctx 发起的调用会带上这些元数据
+func WithMetadata(ctx context.Context, kv ...string) context.Context {
+	md := make(map[string]string)
+	for k, v := range metadata(ctx) {
+		md[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return WithMetadata(ctx, RequestIDKey, id)
+}
+
+// 返回 ctx 中元数据的副本
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md := make(map[string]string)
+	for k, v := range metadata(ctx) {
+		md[k] = v
+	}
+	return md
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	return metadata(ctx)[RequestIDKey]
+}
+
+func metadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
+
+// 服务端把收到的元数据放进处理函数的 ctx，链路信息由 trace 单独处理，这里跳过
+// 尝试次数只属于这一跳，单独记录，不随元数据透传给下游，见 AttemptFromContext
+func newIncomingContext(ctx context.Context, meta map[string]string) context.Context {
+	if n := parseAttempt(meta); n > 1 {
+		ctx = context.WithValue(ctx, attemptKey{}, n)
+	}
+	md := make(map[string]string, len(meta))
+	for k, v := range meta {
+		if k == trace.TraceparentKey || k == AttemptKey {
+			continue
+		}
+		md[k] = v
+	}
+	if len(md) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metadataKey{}, md)
+}
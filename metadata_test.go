@@ -0,0 +1,87 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 03:00:19
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 03:00:19
+ * @FilePath: /TinyRpcByGo/metadata_test.go
+ */
+package tinyrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// 记录收到的尝试次数和元数据
+type ChainBack struct {
+	attempt int
+	meta    map[string]string
+}
+
+func (b *ChainBack) Echo(ctx context.Context, args int, reply *int) error {
+	b.attempt = AttemptFromContext(ctx)
+	b.meta = MetadataFromContext(ctx)
+	*reply = args
+	return nil
+}
+
+// 收到请求后用同一个 ctx 调用下游
+type ChainFront struct {
+	next    *Client
+	attempt int
+}
+
+func (f *ChainFront) Echo(ctx context.Context, args int, reply *int) error {
+	f.attempt = AttemptFromContext(ctx)
+	return f.next.Call(ctx, "ChainBack.Echo", args, reply)
+}
+
+func serveOne(t *testing.T, rcvr interface{}) string {
+	t.Helper()
+	server := NewServer()
+	if err := server.Register(rcvr); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return l.Addr().String()
+}
+
+// 上游的重试次数只属于上游这一跳，处理函数继续调用下游时不会透传，其他元数据照常透传
+func TestAttemptNotForwardedDownstream(t *testing.T) {
+	back := &ChainBack{}
+	backClient, err := Dial("tcp", serveOne(t, back))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backClient.Close()
+	front := &ChainFront{next: backClient}
+	client, err := Dial("tcp", serveOne(t, front))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := WithMetadata(WithRequestID(context.Background(), "req-1"), AttemptKey, "2")
+	var reply int
+	if err := client.Call(ctx, "ChainFront.Echo", 7, &reply); err != nil || reply != 7 {
+		t.Fatalf("reply = %d, err = %v", reply, err)
+	}
+	if front.attempt != 2 {
+		t.Errorf("front attempt = %d, want 2", front.attempt)
+	}
+	if back.attempt != 1 {
+		t.Errorf("downstream attempt = %d, want 1", back.attempt)
+	}
+	if _, ok := back.meta[AttemptKey]; ok {
+		t.Errorf("attempt forwarded downstream: %v", back.meta)
+	}
+	if back.meta[RequestIDKey] != "req-1" {
+		t.Errorf("request id not forwarded: %v", back.meta)
+	}
+}
@@ -9,8 +9,9 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
 	"io"
-	"log"
+	"log/slog"
 	"time"
 	"tinyrpc/config"
 
@@ -20,6 +21,7 @@ import (
 type EtcdClient struct {
 	client  *clientv3.Client
 	timeout time.Duration
+	logger  *slog.Logger
 }
 
 func NewEtcdClient(addr []string, timeout time.Duration) *EtcdClient {
@@ -33,14 +35,42 @@ func NewEtcdClient(addr []string, timeout time.Duration) *EtcdClient {
 	})
 
 	if err != nil {
-		log.Printf("rpc etcd: cannot connect to %s: err: %s", addr, err)
+		slog.Default().Error("rpc registry: cannot connect to etcd", "addr", addr, "err", err)
 		return nil
 	}
 	return &EtcdClient{client: client, timeout: timeout}
 }
 
-func (e *EtcdClient) PutServer(server string) error {
-	return e.Put(config.EtcdProviderPath+"/"+server, server)
+// 设置日志，为空时使用 slog.Default()
+func (e *EtcdClient) SetLogger(logger *slog.Logger) {
+	e.logger = logger
+}
+
+func (e *EtcdClient) log() *slog.Logger {
+	if e.logger != nil {
+		return e.logger
+	}
+	return slog.Default()
+}
+
+// 注册 addr 上的 service 服务，service 为空表示 addr 提供所有服务
+func (e *EtcdClient) PutServer(service string, addr string) error {
+	return e.PutServerItem(ServerItem{Addr: addr, Service: service})
+}
+
+// 以 JSON 保存带元数据（如权重、版本、可用区、标签）的服务实例，服务发现同时兼容只保存地址的旧格式
+// key 为 EtcdProviderPath/服务名/地址，没有服务名时为 EtcdProviderPath/地址
+func (e *EtcdClient) PutServerItem(item ServerItem) error {
+	item.normalize()
+	value, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	key := config.EtcdProviderPath + "/" + item.Addr
+	if item.Service != "" {
+		key = config.EtcdProviderPath + "/" + item.Service + "/" + item.Addr
+	}
+	return e.Put(key, string(value))
 }
 
 //用于创建租约，
@@ -64,9 +94,15 @@ func (e *EtcdClient) Put(key, value string) error {
 
 	//利用心跳给key 续租
 	keepAlive, err := lease.KeepAlive(context.TODO(), leaseGrantResponse.ID)
+	if err != nil {
+		return err
+	}
 
 	// 消耗续约服务端返回的消息
-	go leaseKeepAlive(keepAlive)
+	go func() {
+		leaseKeepAlive(keepAlive)
+		e.log().Warn("rpc registry: etcd lease keepalive stopped", "key", key)
+	}()
 	return nil
 }
 
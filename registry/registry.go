@@ -8,23 +8,79 @@
 package registry
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"tinyrpc"
 )
 
 type TinyRegistry struct {
 	timeout time.Duration
 	mu      sync.Mutex
-	servers map[string]*ServerItem
+	servers map[string]*ServerItem // key 为 服务名/地址，同一个地址提供多个服务时每个服务一项
+	logger  *slog.Logger
+	store   Store      // 为空时不持久化
+	pending []storeOp  // 等待写入 store 的修改，按修改的顺序排列
+	storeMu sync.Mutex // 写 store 时持有，保证按顺序写入，写入时不持有 mu，不阻塞注册和查询
 }
 
+// 一次对 store 的修改，delete 为 false 时是 Put
+type storeOp struct {
+	delete bool
+	rec    StoreRecord
+}
+
+// 服务实例，GET 时以 JSON 返回给服务发现，字段与 xclient.Instance 保持一致
+// 除了 Addr 都是可选的元数据，客户端可以按元数据选择实例，如 version=v2 做金丝雀发布
 type ServerItem struct {
-	Addr  string
-	start time.Time
+	Addr     string
+	Service  string            `json:",omitempty"` // 提供的服务名，为空表示提供所有服务（旧版本的注册方式）
+	Weight   int               `json:",omitempty"` // 加权负载均衡的权重，0 表示使用默认权重
+	Version  string            `json:",omitempty"` // 服务的版本
+	Zone     string            `json:",omitempty"` // 所在的可用区
+	Protocol string            `json:",omitempty"` // 同 XDial 中的 protocol，Addr 没有带 protocol@ 时补在 Addr 前面
+	Tags     map[string]string `json:",omitempty"` // 其他自定义的标签
+	start    time.Time
+}
+
+func (item *ServerItem) key() string {
+	return item.Service + "/" + item.Addr
+}
+
+// Addr 与 Protocol 保持一致，Addr 总是 protocol@addr 的格式，见 tinyrpc.NormalizeAddr
+func (item *ServerItem) normalize() {
+	item.Addr, item.Protocol = tinyrpc.NormalizeAddr(item.Addr, item.Protocol)
+}
+
+// 标签在 HTTP 头中的格式为 k1=v1,k2=v2
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func parseTags(s string) map[string]string {
+	var tags map[string]string
+	for _, pair := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(pair, "=")
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[k] = strings.TrimSpace(v)
+	}
+	return tags
 }
 
 const (
@@ -39,63 +95,184 @@ func NewRegistry(timeout time.Duration) *TinyRegistry {
 	}
 }
 
+// 使用持久化存储，从 store 中恢复上次保存的服务列表，已经过期的服务不再恢复
+// store 由调用方关闭
+func NewRegistryWithStore(timeout time.Duration, store Store) (*TinyRegistry, error) {
+	records, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	r := NewRegistry(timeout)
+	r.store = store
+	for _, rec := range records {
+		item := rec.Item
+		item.start = rec.Heartbeat
+		if r.expired(&item, time.Now()) {
+			_ = store.Delete(item)
+			continue
+		}
+		r.servers[item.key()] = &item
+	}
+	r.log().Info("rpc registry: servers restored from store", "servers", len(r.servers), "expired", len(records)-len(r.servers))
+	return r, nil
+}
+
 var DefaultRegitsry = NewRegistry(defaultTimeout)
 
+// 设置日志，为空时使用 slog.Default()
+func (r *TinyRegistry) SetLogger(logger *slog.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger = logger
+}
+
+// 调用方需持有锁
+func (r *TinyRegistry) log() *slog.Logger {
+	if r.logger != nil {
+		return r.logger
+	}
+	return slog.Default()
+}
+
 //-------------------------------------------------------------------------------------
 // 实现添加服务实例和返回服务列表的方法
 // putServer 添加服务实例，如果服务已经存在则更新start时间
-// aliveServers 返回可用的服务列表，如果存在超时的服务，则删除
+// aliveItems 返回可用的服务列表，如果存在超时的服务，则删除
+// 两者对 store 的修改在释放锁之后写入
 
-func (r *TinyRegistry) putServer(addr string) {
+func (r *TinyRegistry) putServer(item ServerItem) {
+	defer r.flushStore()
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	s := r.servers[addr]
+	item.normalize()
+	s := r.servers[item.key()]
 
 	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
+		r.log().Info("rpc registry: server registered", "addr", item.Addr, "service", item.Service, "weight", item.Weight,
+			"version", item.Version, "zone", item.Zone, "tags", formatTags(item.Tags))
+		item.start = time.Now()
+		r.servers[item.key()] = &item
 	} else {
-		s.start = time.Now()
+		// 心跳中带上的元数据以最新的为准
+		item.start = time.Now()
+		*s = item
 	}
+	r.enqueue(storeOp{rec: StoreRecord{Item: item, Heartbeat: item.start}})
 }
 
-func (r *TinyRegistry) aliveServers() []string {
+// 调用方需持有锁
+func (r *TinyRegistry) enqueue(op storeOp) {
+	if r.store != nil {
+		r.pending = append(r.pending, op)
+	}
+}
+
+// 把等待的修改写入 store，调用方不能持有 mu
+// 修改在 mu 中按顺序排队，持有 storeMu 的一方一次取走全部修改，后排队的修改一定在之后写入
+// 同时有多个请求时，一次写入多个修改
+func (r *TinyRegistry) flushStore() {
+	if r.store == nil {
+		return
+	}
+	r.storeMu.Lock()
+	defer r.storeMu.Unlock()
+	r.mu.Lock()
+	ops, logger := r.pending, r.log()
+	r.pending = nil
+	r.mu.Unlock()
+
+	for _, op := range ops {
+		if op.delete {
+			if err := r.store.Delete(op.rec.Item); err != nil {
+				logger.Warn("rpc registry: delete server from store error", "addr", op.rec.Item.Addr, "err", err)
+			}
+		} else if err := r.store.Put(op.rec); err != nil {
+			logger.Warn("rpc registry: store server error", "addr", op.rec.Item.Addr, "err", err)
+		}
+	}
+}
+
+// 调用方需持有锁
+func (r *TinyRegistry) expired(item *ServerItem, now time.Time) bool {
+	return r.timeout != 0 && !item.start.Add(r.timeout).After(now)
+}
+
+// service 不为空时只返回提供该服务的实例，包括没有指定服务名的实例
+func (r *TinyRegistry) aliveItems(service string) []ServerItem {
+	defer r.flushStore()
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	var alive []string
+	var alive []ServerItem
 
-	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
+	for key, s := range r.servers {
+		if !r.expired(s, time.Now()) {
+			if service == "" || s.Service == "" || s.Service == service {
+				alive = append(alive, *s)
+			}
 		} else {
-			delete(r.servers, addr)
+			r.log().Info("rpc registry: server expired", "addr", s.Addr, "service", s.Service, "last_heartbeat", s.start)
+			delete(r.servers, key)
+			r.enqueue(storeOp{delete: true, rec: StoreRecord{Item: *s}})
 		}
 	}
 
-	sort.Strings(alive)
+	sort.Slice(alive, func(i, j int) bool {
+		if alive[i].Addr != alive[j].Addr {
+			return alive[i].Addr < alive[j].Addr
+		}
+		return alive[i].Service < alive[j].Service
+	})
 
 	return alive
 }
 
 //-------------------------------------------------------------------------------------
 // 注册中心采用HTTP协议，信息都保存在HTTP Header中，继承http.handler,需要重写ServeHTTP方法
-// Get  返回所有的可用服务列表，通过自定义字段X-tinyrpc-Servers承载
-// Post 添加服务实例或发送心跳，通过自定义字段X-tinurpc-Server承载
+// Get  返回所有的可用服务列表，通过自定义字段X-tinyrpc-Servers承载，响应体中是带元数据的 JSON 实例列表，带上 ?service=Arith 时只返回提供 Arith 服务的实例
+// Post 添加服务实例或发送心跳，通过自定义字段X-tinurpc-Server承载，可选的X-tinyrpc-Service为服务名，X-tinyrpc-Weight为权重，
+// X-tinyrpc-Version、X-tinyrpc-Zone、X-tinyrpc-Protocol为版本、可用区和协议，X-tinyrpc-Tags为 k1=v1,k2=v2 格式的标签
 var _ http.Handler = (*TinyRegistry)(nil)
 
 func (r *TinyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		// 将所有可用服务写在响应头上， 然后根据","分割服务地址
-		w.Header().Set("X-tinyrpc-Servers", strings.Join(r.aliveServers(), ","))
+		items := r.aliveItems(req.URL.Query().Get("service"))
+		alive := make([]string, 0, len(items))
+		for i, item := range items {
+			// 同一个地址提供多个服务时会有多项，已按地址排序，去掉重复的地址
+			if i == 0 || item.Addr != items[i-1].Addr {
+				alive = append(alive, item.Addr)
+			}
+		}
+		w.Header().Set("X-tinyrpc-Servers", strings.Join(alive, ","))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(items)
 	case "POST":
 		addr := req.Header.Get("X-tinyrpc-Server")
 		if addr == "" {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		item := ServerItem{
+			Addr:     addr,
+			Service:  req.Header.Get("X-tinyrpc-Service"),
+			Version:  req.Header.Get("X-tinyrpc-Version"),
+			Zone:     req.Header.Get("X-tinyrpc-Zone"),
+			Protocol: req.Header.Get("X-tinyrpc-Protocol"),
+			Tags:     parseTags(req.Header.Get("X-tinyrpc-Tags")),
+		}
+		if weight := req.Header.Get("X-tinyrpc-Weight"); weight != "" {
+			n, err := strconv.Atoi(weight)
+			if err != nil {
+				http.Error(w, "rpc registry: invalid weight", http.StatusBadRequest)
+				return
+			}
+			item.Weight = n
+		}
+		r.putServer(item)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -103,7 +280,9 @@ func (r *TinyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 func (r *TinyRegistry) HandleHTTP(regitsryPath string) {
 	http.Handle(regitsryPath, r)
-	log.Println("rpc registry path:", regitsryPath)
+	r.mu.Lock()
+	r.log().Info("rpc registry: path registered", "path", regitsryPath)
+	r.mu.Unlock()
 }
 
 func HandleHTTP() {
@@ -113,7 +292,18 @@ func HandleHTTP() {
 //-------------------------------------------------------------------------------------
 // 实现心跳机制
 
-func Heartbeat(registry string, addr string, duration time.Duration) {
+// 为 addr 上的 service 服务发送心跳，service 为空表示 addr 提供所有服务
+// 一个地址提供多个服务时，每个服务各自发送心跳
+func Heartbeat(registry string, service string, addr string, duration time.Duration) {
+	HeartbeatItem(registry, ServerItem{Addr: addr, Service: service}, duration, nil)
+}
+
+// 带元数据（如权重、版本、可用区、标签）的心跳
+// logger 为空时使用 slog.Default()
+func HeartbeatItem(registry string, item ServerItem, duration time.Duration, logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
 	//发送心跳时间比超时时间少一分钟
 	if duration == 0 {
 		duration = defaultTimeout - time.Duration(1)*time.Minute
@@ -121,27 +311,52 @@ func Heartbeat(registry string, addr string, duration time.Duration) {
 
 	var err error
 
-	err = sendHeartbeat(registry, addr)
+	err = sendHeartbeat(registry, item, logger)
 
 	go func() {
 		t := time.NewTicker(duration)
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(registry, item, logger)
 		}
 	}()
 }
 
 // 与定时器channel配合定时使用POST请求发送心跳包
-func sendHeartbeat(registry string, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
+func sendHeartbeat(registry string, item ServerItem, logger *slog.Logger) error {
+	addr := item.Addr
+	logger.Debug("rpc registry: send heartbeat", "addr", addr, "service", item.Service, "registry", registry)
 
 	httpClient := &http.Client{}
 
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set("X-tinyrpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: heart beat err:", err)
+	if item.Service != "" {
+		req.Header.Set("X-tinyrpc-Service", item.Service)
+	}
+	if item.Weight > 0 {
+		req.Header.Set("X-tinyrpc-Weight", strconv.Itoa(item.Weight))
+	}
+	for header, value := range map[string]string{
+		"X-tinyrpc-Version":  item.Version,
+		"X-tinyrpc-Zone":     item.Zone,
+		"X-tinyrpc-Protocol": item.Protocol,
+		"X-tinyrpc-Tags":     formatTags(item.Tags),
+	} {
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Error("rpc registry: heartbeat error", "addr", addr, "registry", registry, "err", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	// 地址为空、权重不合法或者请求的不是注册中心时，心跳没有生效，不能当作成功
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("rpc registry: heartbeat rejected: %s", resp.Status)
+		logger.Error("rpc registry: heartbeat error", "addr", addr, "registry", registry, "err", err)
 		return err
 	}
 	return nil
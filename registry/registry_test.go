@@ -0,0 +1,43 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 03:05:49
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 03:05:49
+ * @FilePath: /TinyRpcByGo/registry/registry_test.go
+ */
+package registry
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendHeartbeatStatus(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r := NewRegistry(time.Minute)
+	r.SetLogger(logger)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	if err := sendHeartbeat(srv.URL, ServerItem{Addr: "tcp@10.0.0.1:8001", Service: "Arith"}, logger); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	if items := r.aliveItems(""); len(items) != 1 || items[0].Addr != "tcp@10.0.0.1:8001" {
+		t.Errorf("unexpected items %+v", items)
+	}
+
+	// 注册中心拒绝的心跳返回错误
+	if err := sendHeartbeat(srv.URL, ServerItem{}, logger); err == nil {
+		t.Error("expect error for heartbeat without addr")
+	}
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	if err := sendHeartbeat(notFound.URL, ServerItem{Addr: "tcp@10.0.0.1:8001"}, logger); err == nil {
+		t.Error("expect error for status 404")
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:14:08
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 03:02:05
+ * @FilePath: /TinyRpcByGo/registry/store.go
+ */
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//-------------------------------------------------------------------------------------
+// 注册中心的持久化存储
+// 注册中心重启后从存储中恢复服务列表，不用等每个服务的下一次心跳
+// 恢复的服务按保存的心跳时间计算是否过期，而不是按重启的时间
+
+// 保存的服务实例及其最后一次心跳的时间
+type StoreRecord struct {
+	Item      ServerItem
+	Heartbeat time.Time
+}
+
+// 注册中心的存储接口
+// 1. Load() 启动时加载保存的所有服务实例
+// 2. Put(rec) 服务注册或者发送心跳时保存
+// 3. Delete(item) 服务过期时删除
+type Store interface {
+	Load() ([]StoreRecord, error)
+	Put(rec StoreRecord) error
+	Delete(item ServerItem) error
+	Close() error
+}
+
+// 基于文件的存储，快照加追加日志
+// dir/snapshot.json 是某一时刻的完整服务列表，dir/log.jsonl 是之后的每一次修改
+// 加载时先读快照再重放日志，日志最后一行不完整时（写到一半进程退出）忽略这一行，其他行损坏时返回错误
+// 日志超过 compactEntries 条时把当前的服务列表写成新的快照，并清空日志
+// 快照先写到临时文件再改名，任何时候都有一份完整的快照
+// 日志写失败时截断到写之前的位置，截断也失败时在下一次写之前重新合并快照，不会在日志中间留下不完整的行
+// 追加日志不做 fsync：服务每个心跳周期都会重新上报，掉电时丢掉的最后几条修改在下一次心跳后恢复，
+// 每个心跳都 fsync 的代价比这要高，快照仍然 fsync 后再改名
+type FileStore struct {
+	mu      sync.Mutex
+	dir     string
+	records map[string]StoreRecord // 与文件中的内容一致，写快照时使用
+	file    *os.File               // 日志文件
+	entries int                    // 日志中的条数
+	size    int64                  // 日志中完整的行的长度，写失败时截断到这里
+	broken  bool                   // 写失败后没能截断，日志末尾可能有不完整的行
+	loaded  bool
+	closed  bool
+	logger  *slog.Logger
+}
+
+const (
+	snapshotFile          = "snapshot.json"
+	logFile               = "log.jsonl"
+	defaultCompactEntries = 1000
+	maxStoreEntry         = 16 << 20 // 一条日志的最大长度
+)
+
+var _ Store = (*FileStore)(nil)
+
+// 一条日志，Op 为 put 或者 delete
+type storeEntry struct {
+	Op     string
+	Record StoreRecord
+}
+
+// dir 不存在时创建，第一次 Load、Put 或 Delete 时才读取文件，需要设置日志时在这之前调用 SetLogger
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{
+		dir:     dir,
+		records: make(map[string]StoreRecord),
+	}, nil
+}
+
+// 设置日志，为空时使用 slog.Default()
+func (s *FileStore) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+// 调用方需持有锁
+func (s *FileStore) log() *slog.Logger {
+	if s.logger != nil {
+		return s.logger
+	}
+	return slog.Default()
+}
+
+// 调用方需持有锁
+func (s *FileStore) load() error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	if s.loaded {
+		return nil
+	}
+	if err := s.readSnapshot(); err != nil {
+		return err
+	}
+	if err := s.replayLog(); err != nil {
+		return err
+	}
+	// 加载后立即合并成新的快照，去掉日志中不完整的行
+	if err := s.compact(); err != nil {
+		return err
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *FileStore) readSnapshot() error {
+	content, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []StoreRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		s.records[rec.Item.key()] = rec
+	}
+	return nil
+}
+
+func (s *FileStore) replayLog() error {
+	f, err := os.Open(filepath.Join(s.dir, logFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStoreEntry)
+	// 只有最后一行可能是写到一半的，后面还有内容时说明文件损坏了，不能跳过中间的修改
+	var broken error
+	for scanner.Scan() {
+		if broken != nil {
+			return fmt.Errorf("rpc registry: broken store log entry in %s: %v", s.dir, broken)
+		}
+		var e storeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			broken = err
+			continue
+		}
+		s.apply(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if broken != nil {
+		s.log().Warn("rpc registry: ignore broken last store log entry", "dir", s.dir, "err", broken)
+	}
+	return nil
+}
+
+func (s *FileStore) apply(e storeEntry) {
+	switch e.Op {
+	case "put":
+		s.records[e.Record.Item.key()] = e.Record
+	case "delete":
+		delete(s.records, e.Record.Item.key())
+	}
+}
+
+// 调用方需持有锁
+func (s *FileStore) compact() error {
+	records := make([]StoreRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Item.key() < records[j].Item.key() })
+	content, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	// 快照已经包含了日志中的所有修改，可以清空日志
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file, err = os.OpenFile(filepath.Join(s.dir, logFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	s.entries, s.size = 0, 0
+	if err == nil {
+		s.broken = false
+	}
+	return err
+}
+
+func (s *FileStore) append(e storeEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if s.broken {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if len(line) >= maxStoreEntry {
+		return fmt.Errorf("rpc registry: store log entry too large: %d bytes", len(line))
+	}
+	n, err := s.file.Write(append(line, '\n'))
+	if err != nil {
+		if terr := s.file.Truncate(s.size); terr != nil {
+			s.broken = true
+		}
+		return err
+	}
+	s.size += int64(n)
+	s.apply(e)
+	s.entries++
+	if s.entries >= defaultCompactEntries {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStore) Load() ([]StoreRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	records := make([]StoreRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (s *FileStore) Put(rec StoreRecord) error {
+	return s.append(storeEntry{Op: "put", Record: rec})
+}
+
+func (s *FileStore) Delete(item ServerItem) error {
+	return s.append(storeEntry{Op: "delete", Record: StoreRecord{Item: item}})
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
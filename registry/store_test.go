@@ -0,0 +1,188 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 03:02:05
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 03:02:05
+ * @FilePath: /TinyRpcByGo/registry/store_test.go
+ */
+package registry
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T, dir string) (*FileStore, []StoreRecord, error) {
+	t.Helper()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	s.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	records, err := s.Load()
+	sort.Slice(records, func(i, j int) bool { return records[i].Item.key() < records[j].Item.key() })
+	return s, records, err
+}
+
+func record(addr string) StoreRecord {
+	return StoreRecord{
+		Item:      ServerItem{Addr: addr, Service: "Arith", Weight: 10, Tags: map[string]string{"canary": "true"}},
+		Heartbeat: time.Unix(1700000000, 0).UTC(),
+	}
+}
+
+func addrsOf(records []StoreRecord) []string {
+	addrs := make([]string, 0, len(records))
+	for _, rec := range records {
+		addrs = append(addrs, rec.Item.Addr)
+	}
+	return addrs
+}
+
+func appendLog(t *testing.T, dir, content string) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s, records, err := openStore(t, dir)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("empty store: records = %v, err = %v", records, err)
+	}
+	for _, addr := range []string{"tcp@a:1", "tcp@b:1", "tcp@c:1"} {
+		if err := s.Put(record(addr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(record("tcp@b:1").Item); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+
+	_, records, err = openStore(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(addrsOf(records)); got != "[tcp@a:1 tcp@c:1]" {
+		t.Fatalf("records = %s", got)
+	}
+	want := record("tcp@a:1")
+	got := records[0]
+	if got.Item.Weight != want.Item.Weight || got.Item.Tags["canary"] != "true" || !got.Heartbeat.Equal(want.Heartbeat) {
+		t.Errorf("record = %+v, want %+v", got, want)
+	}
+}
+
+// 写到一半退出时只有最后一行不完整，忽略这一行，之前的修改都在
+func TestFileStoreTruncatedLastLine(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _ := openStore(t, dir)
+	if err := s.Put(record("tcp@a:1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	appendLog(t, dir, `{"Op":"put","Record":{"Item":{"Addr":"tcp@b:1"`)
+
+	s, records, err := openStore(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(addrsOf(records)); got != "[tcp@a:1]" {
+		t.Fatalf("records = %s", got)
+	}
+	// 加载后合并了快照，不完整的行不会影响之后的写入
+	if err := s.Put(record("tcp@c:1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	if _, records, err = openStore(t, dir); err != nil || fmt.Sprint(addrsOf(records)) != "[tcp@a:1 tcp@c:1]" {
+		t.Fatalf("records = %v, err = %v", addrsOf(records), err)
+	}
+}
+
+// 中间的行损坏时不能跳过，跳过会丢掉中间的修改
+func TestFileStoreCorruptMiddleLine(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _ := openStore(t, dir)
+	if err := s.Put(record("tcp@a:1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	appendLog(t, dir, "garbage\n"+`{"Op":"delete","Record":{"Item":{"Addr":"tcp@a:1","Service":"Arith"}}}`+"\n")
+
+	if _, _, err := openStore(t, dir); err == nil {
+		t.Fatal("expect error for a corrupt line in the middle of the log")
+	}
+}
+
+// 合并快照前后的内容一致
+func TestFileStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _ := openStore(t, dir)
+	n := defaultCompactEntries + 10
+	for i := 0; i < n; i++ {
+		if err := s.Put(record(fmt.Sprintf("tcp@h:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(record("tcp@h:0").Item); err != nil {
+		t.Fatal(err)
+	}
+	if s.entries >= defaultCompactEntries {
+		t.Errorf("log not compacted, %d entries", s.entries)
+	}
+	_ = s.Close()
+
+	_, records, err := openStore(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != n-1 {
+		t.Fatalf("expect %d records, got %d", n-1, len(records))
+	}
+	for _, rec := range records {
+		if rec.Item.Addr == "tcp@h:0" {
+			t.Error("deleted record restored")
+		}
+	}
+}
+
+// 日志写失败后下一次写入前重新合并快照，日志中不会留下不完整的行
+func TestFileStoreRecoversFromWriteError(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _ := openStore(t, dir)
+	if err := s.Put(record("tcp@a:1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.file.Close() // 模拟写失败
+	if err := s.Put(record("tcp@b:1")); err == nil {
+		t.Fatal("expect write error")
+	}
+	if err := s.Put(record("tcp@c:1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+
+	_, records, err := openStore(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(addrsOf(records)); got != "[tcp@a:1 tcp@c:1]" {
+		t.Fatalf("records = %s", got)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 18:12:40
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 18:12:40
+ * @FilePath: /TinyRpcByGo/retry.go
+ */
+package tinyrpc
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 重试的第几次尝试放在元数据中发送，第一次调用不带，服务端的访问日志和处理函数都能看到
+const AttemptKey = "rpc-attempt"
+
+// 重试策略，通过 Option.Retry 设置
+// 第 n 次重试前等待 min(InitialBackoff * Multiplier^(n-1), MaxBackoff)，再随机浮动 ±Jitter
+// 每次尝试都受调用方 ctx 的截止时间约束，剩余时间不够等待时直接返回上一次的错误
+type RetryPolicy struct {
+	MaxAttempts    int           // 最多尝试的次数，包括第一次调用，不大于 1 时不重试
+	InitialBackoff time.Duration // 第一次重试前等待的时间
+	MaxBackoff     time.Duration // 等待时间的上限，为 0 时不限制
+	Multiplier     float64       // 每次重试等待时间的倍数，小于 1 时按 1 处理
+	Jitter         float64       // 等待时间随机浮动的比例，取值 0~1
+	RetryableCodes []Code        // 可以重试的错误码，为空时只重试 CodeUnavailable
+
+	// 按 "Service.Method" 覆盖的策略，其中的零值字段沿用外层策略的值
+	Methods map[string]*RetryPolicy
+	// 重试预算，为空时不限制，多个客户端可以共用一个预算
+	Budget *RetryBudget
+}
+
+// 返回方法实际使用的策略
+func (p *RetryPolicy) ForMethod(serviceMethod string) *RetryPolicy {
+	m, ok := p.Methods[serviceMethod]
+	if !ok {
+		return p
+	}
+	merged := *m
+	if merged.MaxAttempts == 0 {
+		merged.MaxAttempts = p.MaxAttempts
+	}
+	if merged.InitialBackoff == 0 {
+		merged.InitialBackoff = p.InitialBackoff
+	}
+	if merged.MaxBackoff == 0 {
+		merged.MaxBackoff = p.MaxBackoff
+	}
+	if merged.Multiplier == 0 {
+		merged.Multiplier = p.Multiplier
+	}
+	if merged.Jitter == 0 {
+		merged.Jitter = p.Jitter
+	}
+	if merged.RetryableCodes == nil {
+		merged.RetryableCodes = p.RetryableCodes
+	}
+	if merged.Budget == nil {
+		merged.Budget = p.Budget
+	}
+	merged.Methods = nil
+	return &merged
+}
+
+// 错误码是否可以重试
+func (p *RetryPolicy) Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := ErrorCode(err)
+	if len(p.RetryableCodes) == 0 {
+		return code == CodeUnavailable
+	}
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// 第 retry 次重试前等待的时间，retry 从 1 开始
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(mult, float64(retry-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		backoff *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(backoff)
+}
+
+// 按策略执行 fn，attempt 从 1 开始，重试时 ctx 的元数据中带有 AttemptKey
+// retryable 为空时按 RetryableCodes 判断错误能否重试，不为空时由 retryable 决定
+func (p *RetryPolicy) Do(ctx context.Context, retryable func(err error) bool, fn func(ctx context.Context, attempt int) error) error {
+	if retryable == nil {
+		retryable = p.Retryable
+	}
+	if p.Budget != nil {
+		p.Budget.Deposit()
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		actx := ctx
+		if attempt > 1 {
+			actx = WithMetadata(ctx, AttemptKey, strconv.Itoa(attempt))
+		}
+		err = fn(actx, attempt)
+		if attempt >= p.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+
+		backoff := p.Backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+			return err
+		}
+		if p.Budget != nil && !p.Budget.Withdraw() {
+			return err
+		}
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+type attemptKey struct{}
+
+// 返回服务端处理函数收到的请求是第几次尝试，第一次调用为 1
+// 收到的尝试次数不放在 ctx 的元数据中，处理函数用这个 ctx 调用下游时不会把上游的重试次数带过去
+func AttemptFromContext(ctx context.Context) int {
+	if n, ok := ctx.Value(attemptKey{}).(int); ok {
+		return n
+	}
+	return 1
+}
+
+// 元数据中的尝试次数，没有时为 1
+func parseAttempt(md map[string]string) int {
+	if n, err := strconv.Atoi(md[AttemptKey]); err == nil && n > 0 {
+		return n
+	}
+	return 1
+}
+
+//-------------------------------------------------------------------------------------
+// 重试预算，把重试限制在正常请求的一定比例内，避免服务端故障时重试把流量放大成重试风暴
+// xclient 的对冲请求也使用它限制额外发送的请求
+// 每个请求存入 ratio 个令牌，每次重试取出一个，令牌不足时不再重试，burst 为令牌的上限，也是初始值
+
+type RetryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+// ratio 为允许重试的比例，比如 0.1 表示重试最多占请求数的 10%
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, burst: float64(burst), tokens: float64(burst)}
+}
+
+// 每个请求调用一次，存入 ratio 个令牌
+func (b *RetryBudget) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.tokens+b.ratio, b.burst)
+}
+
+// 重试前调用，取出一个令牌，令牌不足时返回 false
+func (b *RetryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 当前剩余的令牌数
+func (b *RetryBudget) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
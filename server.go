@@ -8,18 +8,22 @@
 package tinyrpc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"tinyrpc/codec"
+	"tinyrpc/trace"
 )
 
 const MagicNumber = 0x3bef5c
@@ -32,6 +36,18 @@ type Option struct {
 	CodecType      codec.Type //指定选择的解码编码格式，gob or json
 	ConnectTimeout time.Duration
 	HandleTimeout  time.Duration
+	Logger         *slog.Logger `json:"-"` // 客户端日志，不参与协商；为空时使用 slog.Default()
+	Retry          *RetryPolicy `json:"-"` // 客户端的重试策略，不参与协商；为空时不重试
+	// 服务端在握手的响应中设置，表示能够处理取消帧，客户端只向支持的服务端发送
+	// 旧版本的服务端原样返回客户端的 Option，不会带上这个字段，客户端设置它没有作用
+	CancelFrame bool `json:",omitempty"`
+}
+
+func (opt *Option) logger() *slog.Logger {
+	if opt.Logger != nil {
+		return opt.Logger
+	}
+	return slog.Default()
 }
 
 var DefaultOption = &Option{
@@ -49,10 +65,44 @@ var DefaultOption = &Option{
 
 type Server struct {
 	serviceMap sync.Map
+	tracer     *trace.Tracer // 为每次调用创建服务端 span，为空时只透传链路信息
+	logger     *slog.Logger  // 为空时使用 slog.Default()，级别由 logger 的 Handler 控制
+	accessLog  *accessLogger // 访问日志，每个请求一条记录
+	slowLog    *slowLogger   // 慢调用日志，耗时超过阈值的请求才记录
+
+	mu         sync.Mutex
+	conns      map[uint64]*serverConn // 当前的所有连接，用于调试页面
+	nextConnID uint64
+}
+
+// 服务端的可选配置
+type ServerOption func(*Server)
+
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(server *Server) {
+		server.logger = logger
+	}
+}
+
+func WithTracer(tracer *trace.Tracer) ServerOption {
+	return func(server *Server) {
+		server.tracer = tracer
+	}
 }
 
-func NewServer() *Server {
-	return &Server{}
+func NewServer(opts ...ServerOption) *Server {
+	server := &Server{conns: make(map[uint64]*serverConn)}
+	for _, opt := range opts {
+		opt(server)
+	}
+	return server
+}
+
+func (server *Server) log() *slog.Logger {
+	if server.logger != nil {
+		return server.logger
+	}
+	return slog.Default()
 }
 
 /*
@@ -69,7 +119,7 @@ func (server *Server) Accept(lis net.Listener) {
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error", err)
+			server.log().Error("rpc server: accept error", "err", err)
 			return
 		}
 		go server.ServerConn(conn)
@@ -93,35 +143,161 @@ func (server *Server) ServerConn(conn io.ReadWriteCloser) {
 		_ = conn.Close()
 	}()
 
+	remoteAddr := ""
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		remoteAddr = c.RemoteAddr().String()
+	}
+
 	var opt Option
 
 	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Println("rpv server: options error", err)
+		server.log().Warn("rpc server: decode options error", "remote_addr", remoteAddr, "err", err)
 		return
 	}
 
 	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number: %x", opt.MagicNumber)
+		server.log().Warn("rpc server: invalid magic number", "remote_addr", remoteAddr, "magic_number", fmt.Sprintf("%x", opt.MagicNumber))
 		return
 	}
 
 	f := codec.NewCodecFuncMap[opt.CodecType]
 
 	if f == nil {
-		log.Printf("rpc sever: invalid codec type %s", opt.CodecType)
+		server.log().Warn("rpc server: invalid codec type", "remote_addr", remoteAddr, "codec", opt.CodecType)
 		return
 	}
 
-	// 给客户端一个响应，说明此次 Option 是 ok 的
+	// 给客户端一个响应，说明此次 Option 是 ok 的，同时告诉客户端支持取消帧
+	opt.CancelFrame = true
 	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc server: option error: ", err)
+		server.log().Warn("rpc server: send options error", "remote_addr", remoteAddr, "err", err)
 		return
 	}
-	server.serverCodec(f(conn), opt.HandleTimeout)
+
+	// 编解码器基于计数的连接创建，用来统计每个请求体和响应的字节数
+	mc := newMeteredConn(conn)
+	sc := &serverConn{
+		cc:         f(mc),
+		mc:         mc,
+		remoteAddr: remoteAddr,
+		codecType:  opt.CodecType,
+		timeout:    opt.HandleTimeout,
+		start:      time.Now(),
+		requests:   make(map[uint64]*request),
+	}
+	server.trackConn(sc, true)
+	defer server.trackConn(sc, false)
+	server.serverCodec(sc)
+}
+
+func (server *Server) getConn(id uint64) *serverConn {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.conns[id]
+}
+
+// 取消某个连接上正在执行的请求，用于运维排查卡住的处理函数
+func (server *Server) cancelRequest(connID, seq uint64) bool {
+	sc := server.getConn(connID)
+	return sc != nil && sc.cancelRequest(seq)
+}
+
+// 关闭某个连接，连接上所有请求随之取消
+func (server *Server) closeConn(connID uint64) bool {
+	sc := server.getConn(connID)
+	if sc == nil {
+		return false
+	}
+	_ = sc.cc.Close()
+	return true
+}
+
+func (server *Server) trackConn(sc *serverConn, add bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		server.nextConnID++
+		sc.id = server.nextConnID
+		server.conns[sc.id] = sc
+	} else {
+		delete(server.conns, sc.id)
+	}
 }
 
 var invalidRequest = struct{}{} // 用于当发生错误解码时，发送的占位接口
 
+// 取消帧使用的服务名，请求头中的 Seq 为要取消的请求，服务名不可能与注册的服务冲突
+const CancelServiceMethod = "_tinyrpc.Cancel"
+
+// 一个连接的状态，连接上的所有请求共用
+type serverConn struct {
+	id         uint64
+	cc         codec.Codec
+	mc         *meteredConn
+	remoteAddr string
+	codecType  codec.Type
+	timeout    time.Duration // 客户端在 Option 中指定的处理超时
+	start      time.Time
+	sendLock   sync.Mutex // 保证响应一条一条发送
+
+	mu       sync.Mutex
+	requests map[uint64]*request // 正在执行的请求，key 为 seq
+}
+
+// 读完请求就登记，处理函数开始执行时再设置 cancel，这样在处理函数开始前到达的取消也不会丢失
+// 处理函数返回后移除；超时已响应但处理函数还没返回的请求仍然保留
+func (sc *serverConn) trackRequest(req *request) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.requests[req.h.Seq] = req
+}
+
+// 处理函数开始执行，如果请求在这之前已经被取消，立即取消 ctx
+func (sc *serverConn) startRequest(req *request, cancel context.CancelFunc) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	req.cancel = cancel
+	if req.canceled {
+		cancel()
+	}
+}
+
+// 调用方需持有 sc.mu
+func (req *request) cancelLocked() {
+	req.canceled = true
+	if req.cancel != nil {
+		req.cancel()
+	}
+}
+
+func (sc *serverConn) untrackRequest(req *request) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.requests[req.h.Seq] == req {
+		delete(sc.requests, req.h.Seq)
+	}
+}
+
+// 取消连接上 seq 对应的请求，返回是否找到
+func (sc *serverConn) cancelRequest(seq uint64) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	req, ok := sc.requests[seq]
+	if ok {
+		req.cancelLocked()
+	}
+	return ok
+}
+
+// 连接断开后客户端已经收不到响应，取消连接上所有还在执行的请求
+func (sc *serverConn) cancelAll() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, req := range sc.requests {
+		req.cancelLocked()
+	}
+}
+
 /*
 	保存消息属性
 	消息头:header
@@ -132,6 +308,12 @@ type request struct {
 	argv, replyv reflect.Value
 	mtype        *methodType
 	svc          *service
+	sc           *serverConn
+	start        time.Time // 读完请求头的时间，用于统计耗时
+	argSize      int64     // 请求体的字节数
+	responded    int32     // 是否已经发送响应，原子读写
+	cancel       context.CancelFunc
+	canceled     bool // 已经被取消，由 sc.mu 保护
 }
 
 /*
@@ -144,34 +326,34 @@ type request struct {
 	处理请求handleRequest
 	发送sendResponse
 */
-func (server *Server) serverCodec(cc codec.Codec, timeout time.Duration) {
+func (server *Server) serverCodec(sc *serverConn) {
 
-	sendLock := new(sync.Mutex)
 	wgcv := new(sync.WaitGroup)
 
 	for {
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(sc)
 		if err != nil {
 			if req == nil {
 				break
 			}
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sendLock)
+			server.finishRequest(req, invalidRequest, err)
 			continue
 		}
+		sc.trackRequest(req)
 		wgcv.Add(1)
-		go server.handleRequest(cc, req, sendLock, wgcv, timeout)
+		go server.handleRequest(req, wgcv)
 	}
+	sc.cancelAll()
 	wgcv.Wait()
-	_ = cc.Close()
+	_ = sc.cc.Close()
 }
 
-func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
+func (server *Server) readRequestHeader(sc *serverConn) (*codec.Header, error) {
 	var h codec.Header
 
-	if err := cc.ReadHeader(&h); err != nil {
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Println("rpc server: read header err", err)
+	if err := sc.cc.ReadHeader(&h); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, net.ErrClosed) {
+			server.log().Warn("rpc server: read header error", "remote_addr", sc.remoteAddr, "err", err)
 		}
 		return nil, err
 	}
@@ -179,22 +361,41 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 
 }
 
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+func (server *Server) readRequest(sc *serverConn) (*request, error) {
 
-	h, err := server.readRequestHeader(cc)
+	h, err := server.readRequestHeader(sc)
 
 	if err != nil {
 		return nil, err
 	}
 
-	req := &request{h: h}
+	// 取消帧：客户端放弃了 seq 对应的请求，取消处理函数的 ctx，不需要响应
+	for h.ServiceMethod == CancelServiceMethod {
+		_ = sc.cc.ReadBody(nil)
+		if sc.cancelRequest(h.Seq) {
+			server.log().Debug("rpc server: request canceled by client", "seq", h.Seq, "remote_addr", sc.remoteAddr)
+		}
+		if h, err = server.readRequestHeader(sc); err != nil {
+			return nil, err
+		}
+	}
+
+	req := &request{h: h, sc: sc, start: time.Now()}
+
+	// 请求是顺序读取的，读请求体前后的计数差就是请求体的大小
+	read := sc.mc.bytesRead()
+	defer func() {
+		req.argSize = sc.mc.bytesRead() - read
+	}()
 
 	// 1. 目前还不知道args的类型，第一个版本先只支持string(fix)
 	// 2. 通过反射拿到客户端发来请求的service.method ，method包括方法名，入参变量结构体， 返回结果结构体
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 
 	if err != nil {
-		return req, nil
+		// 丢弃请求体，保证后续请求能正常解析
+		_ = sc.cc.ReadBody(nil)
+		return req, err
 	}
 
 	req.argv = req.mtype.newArgv()
@@ -207,24 +408,69 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		argvi = req.argv.Addr().Interface()
 	}
 
-	if err = cc.ReadBody(argvi); err != nil {
-		log.Println("rpc server: read body err:", err)
-		return req, err
+	if err = sc.cc.ReadBody(argvi); err != nil {
+		return req, newError(CodeInvalidArgument, "rpc server: read body error: "+err.Error())
 	}
 
 	return req, nil
 }
 
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sendLock *sync.Mutex) {
-	sendLock.Lock()
-	defer sendLock.Unlock()
+// 发送响应，返回写出的字节数（包括响应头）
+func (server *Server) sendResponse(sc *serverConn, h *codec.Header, body interface{}) int64 {
+	sc.sendLock.Lock()
+	defer sc.sendLock.Unlock()
 
-	if err := cc.Write(h, body); err != nil {
-		log.Println("rpc server: write response error", err)
+	written := sc.mc.bytesWritten()
+	if err := sc.cc.Write(h, body); err != nil {
+		server.log().Warn("rpc server: write response error", "service_method", h.ServiceMethod, "seq", h.Seq, "remote_addr", sc.remoteAddr, "err", err)
+	}
+	return sc.mc.bytesWritten() - written
+}
+
+// 请求处理结束，把错误和错误码写进响应头，发送响应后记录日志
+func (server *Server) finishRequest(req *request, body interface{}, err error) {
+	code := ErrorCode(err)
+	if err != nil {
+		req.h.Error = err.Error()
+		req.h.Code = string(code)
+	}
+	replySize := server.sendResponse(req.sc, req.h, body)
+	atomic.StoreInt32(&req.responded, 1)
+	latency := time.Since(req.start)
+	if req.mtype != nil {
+		req.mtype.observe(latency, err)
+	}
+
+	level := slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	server.log().Log(context.Background(), level, "rpc server: request done",
+		"service_method", req.h.ServiceMethod, "seq", req.h.Seq, "remote_addr", req.sc.remoteAddr,
+		"latency", latency, "code", code, "err", err)
+
+	if server.accessLog == nil && server.slowLog == nil {
+		return
+	}
+	record := &AccessRecord{
+		Time:          req.start,
+		RemoteAddr:    req.sc.remoteAddr,
+		ServiceMethod: req.h.ServiceMethod,
+		Seq:           req.h.Seq,
+		ArgSize:       req.argSize,
+		ReplySize:     replySize,
+		Duration:      latency,
+		Code:          code,
+		Meta:          req.h.Meta,
 	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	server.accessLog.write(record)
+	server.slowLog.write(record, req)
 }
 
-func (server *Server) handleRequest(cc codec.Codec, req *request, sendLock *sync.Mutex, wgcv *sync.WaitGroup, timeout time.Duration) {
+func (server *Server) handleRequest(req *request, wgcv *sync.WaitGroup) {
 	defer wgcv.Done()
 
 	/*err := req.svc.call(req.mtype, req.argv, req.replyv)
@@ -238,45 +484,65 @@ func (server *Server) handleRequest(cc codec.Codec, req *request, sendLock *sync
 	//req.replyv = reflect.ValueOf(fmt.Sprintf("tinyrpc resp %d", req.h.Seq))
 	server.sendResponse(cc, req.h, req.replyv.Interface(), sendLock)*/
 
-	call := make(chan struct{})
-	send := make(chan struct{})
+	// 从请求头中取出上游的链路信息，为本次调用创建子 span，处理函数可以通过 ctx 继续向下游传递
+	ctx := newIncomingContext(context.Background(), req.h.Meta)
+	ctx, span := server.tracer.Start(trace.Extract(ctx, req.h.Meta), req.h.ServiceMethod, trace.SpanKindServer)
+	span.SetAttribute("rpc.seq", strconv.FormatUint(req.h.Seq, 10))
+
+	// 处理超时、运维取消或者连接断开时 ctx 结束，处理函数可以据此提前退出
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timeout := req.sc.timeout
+	if timeout != 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+	req.sc.startRequest(req, cancel)
+
+	// 处理函数返回和 ctx 结束谁先发生谁发送响应，只发送一次
+	var once sync.Once
+	done := make(chan struct{})
 
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		select {
-		case call <- struct{}{}:
-		default:
-			return
-		}
-		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sendLock)
-			send <- struct{}{}
-			return
-		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sendLock)
-		send <- struct{}{}
+		defer close(done)
+		err := req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+		req.sc.untrackRequest(req)
+		once.Do(func() {
+			span.End(err)
+			if err != nil {
+				// 处理函数返回的普通错误归为 internal，返回 *Error 的则保留其错误码
+				if ErrorCode(err) == CodeUnknown {
+					err = newError(CodeInternal, err.Error())
+				}
+				server.finishRequest(req, invalidRequest, err)
+				return
+			}
+			server.finishRequest(req, req.replyv.Interface(), nil)
+		})
 	}()
 
-	if timeout == 0 {
-		<-call
-		<-send
-		return
-	}
-
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sendLock)
-	case <-call:
-		<-send
+	case <-ctx.Done():
+		once.Do(func() {
+			err := newError(CodeCanceled, "rpc server: request canceled")
+			if ctx.Err() == context.DeadlineExceeded {
+				err = newError(CodeDeadlineExceeded, fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout))
+			}
+			span.End(err)
+			server.finishRequest(req, invalidRequest, err)
+		})
+	case <-done:
 	}
 }
 
 //-------------------------------------------------------------------------------------
 // 具体的服务方法注册逻辑，sync.map[服务名]服务的实例
 func (server *Server) Register(rcvr interface{}) error {
-	s := newService(rcvr)
+	s, err := newService(rcvr, server.log())
+	if err != nil {
+		return err
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined: " + s.name)
 	}
@@ -296,7 +562,7 @@ func (server *Server) findService(ServiceMethod string) (svc *service, mtype *me
 	dot := strings.LastIndex(ServiceMethod, ".")
 
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-formed: " + ServiceMethod)
+		err = newError(CodeNotFound, "rpc server: service/method request ill-formed: "+ServiceMethod)
 		return
 	}
 
@@ -305,7 +571,8 @@ func (server *Server) findService(ServiceMethod string) (svc *service, mtype *me
 	svci, ok := server.serviceMap.Load(serviceName)
 
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = newError(CodeNotFound, "rpc server: can't find service "+serviceName)
+		return
 	}
 
 	svc = svci.(*service)
@@ -313,7 +580,7 @@ func (server *Server) findService(ServiceMethod string) (svc *service, mtype *me
 	mtype = svc.method[methodName]
 
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = newError(CodeNotFound, "rpc server: can't find method "+methodName)
 	}
 
 	return
@@ -328,9 +595,10 @@ func (server *Server) findService(ServiceMethod string) (svc *service, mtype *me
 var _ http.Handler = (*Server)(nil)
 
 const (
-	connected        = "200 Connected to RPC"
-	defaultRPCPath   = "/_tinyrpc_"
-	defaultDebugPath = "/debug/tinyrpc"
+	connected           = "200 Connected to RPC"
+	defaultRPCPath      = "/_tinyrpc_"
+	defaultDebugPath    = "/debug/tinyrpc"
+	defaultInflightPath = "/debug/tinyrpc/inflight"
 )
 
 // 实现由http连接到rpc连接的转换
@@ -346,7 +614,7 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	conn, _, err := w.(http.Hijacker).Hijack() // 劫持这个conn用作rpc连接
 
 	if err != nil {
-		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		server.log().Error("rpc server: hijacking error", "remote_addr", req.RemoteAddr, "err", err)
 		return
 	}
 	// 写回 http 响应消息，格式为：响应行\n响应头（头部行）\n响应体。由于没有加响应头（头部行），所以这里末尾写了两个\n
@@ -357,9 +625,23 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (server *Server) HandleHttp() {
 	http.Handle(defaultRPCPath, server)
 	http.Handle(defaultDebugPath, debugHTTP{server})
-	log.Println("rpc server debug path:", defaultDebugPath)
+	server.log().Info("rpc server: debug path registered", "path", defaultDebugPath)
 }
 
 func HandleHttp() {
 	DefaultServer.HandleHttp()
 }
+
+// 注册查看和干预正在执行的请求的运维接口，可以取消请求、关闭连接，需要时单独开启，path 为空时使用 /debug/tinyrpc/inflight
+// 接口没有鉴权，只拒绝来自其他站点的浏览器请求，不要暴露在公网上
+func (server *Server) HandleInflight(path string) {
+	if path == "" {
+		path = defaultInflightPath
+	}
+	http.Handle(path, inflightHTTP{server})
+	server.log().Info("rpc server: inflight path registered", "path", path)
+}
+
+func HandleInflight(path string) {
+	DefaultServer.HandleInflight(path)
+}
@@ -8,23 +8,42 @@
 package tinyrpc
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
-	"log"
+	"log/slog"
 	"reflect"
 	"sync/atomic"
+	"time"
+	"tinyrpc/stats"
 )
 
 type methodType struct {
-	method    reflect.Method //方法本身
-	ArgType   reflect.Type   //第一个参数的类型
-	ReplyType reflect.Type   //返回值的类型 第二个参数的类型
-	numCalls  uint64         //统计方法被调用次数
+	method    reflect.Method   //方法本身
+	ArgType   reflect.Type     //第一个参数的类型
+	ReplyType reflect.Type     //返回值的类型 第二个参数的类型
+	numCalls  uint64           //统计方法被调用次数
+	numErrors uint64           //统计返回错误的次数
+	latency   *stats.Histogram //耗时分布
+	withCtx   bool             //第一个参数是否为 context.Context
 }
 
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType) NumErrors() uint64 {
+	return atomic.LoadUint64(&m.numErrors)
+}
+
+// 记录一次调用的结果，用于调试页面上的错误数和耗时分位数
+func (m *methodType) observe(latency time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&m.numErrors, 1)
+	}
+	m.latency.Observe(latency)
+}
+
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
 
@@ -68,7 +87,7 @@ type service struct {
 	method map[string]*methodType // 存储结构体T的所有符合条件的方法
 }
 
-func newService(rcvr interface{}) *service { // 入参是任意要映射为服务的结构体实例
+func newService(rcvr interface{}, logger *slog.Logger) (*service, error) { // 入参是任意要映射为服务的结构体实例
 	s := new(service)
 	s.rcvr = reflect.ValueOf(rcvr) // 一切基于先得到反射后的实际类型
 
@@ -81,35 +100,47 @@ func newService(rcvr interface{}) *service { // 入参是任意要映射为服
 	s.name = reflect.Indirect(s.rcvr).Type().Name()
 	s.typ = reflect.TypeOf(rcvr) // 通过实例的反射得到结构提的类型，然后通过结构体类型得到method
 	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+		return nil, fmt.Errorf("rpc server: %s is not a valid service name", s.name)
 	}
-	s.registerMethods()
-	return s
+	s.registerMethods(logger)
+	return s, nil
 }
 
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // 通过registerMethods方法 过滤出符合条件的方法
 //func (t *T) MethodName(argType T1, replyType *T2) error
+//func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
 // 1.自身两个导出或内置类型的入参，（反射时是三个，第0个是自身）
-// 2.返回值只有一个 error类型
-func (s *service) registerMethods() {
+// 2.可选的第一个参数 context.Context，携带链路信息，处理函数向下游发起调用时传入即可
+// 3.返回值只有一个 error类型
+func (s *service) registerMethods(logger *slog.Logger) {
 	s.method = make(map[string]*methodType)
 
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
 
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if mType.NumOut() != 1 {
 			continue
 		}
 		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
 			continue
 		}
 
+		withCtx := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if mType.NumIn() != 3 && !withCtx {
+			continue
+		}
+
 		argType, replyType := mType.In(1), mType.In(2)
+		if withCtx {
+			argType, replyType = mType.In(2), mType.In(3)
+		}
 
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
@@ -119,18 +150,24 @@ func (s *service) registerMethods() {
 			method:    method,
 			ArgType:   argType,
 			ReplyType: replyType,
+			latency:   stats.NewHistogram(),
+			withCtx:   withCtx,
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
+		logger.Info("rpc server: register method", "service_method", s.name+"."+method.Name)
 	}
 }
 
 // 通过反射调用方法
-func (s *service) call(m *methodType, argv reflect.Value, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv reflect.Value, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
 
 	// 正常调用是 A.func(argv1, argv2)，反射的时候就是 Call(A, argv1, argv2)。
-	returnValue := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.withCtx {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValue := f.Call(in)
 	if errInter := returnValue[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -0,0 +1,86 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 16:30:40
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 16:30:40
+ * @FilePath: /TinyRpcByGo/stats/histogram.go
+ */
+package stats
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 耗时直方图，桶的上界按 10µs 起步、每次乘 1.2 指数增长，直到 2 分钟
+// 分位数取所在桶的上界，相对误差在 20% 以内，换来无锁的 Observe
+type Histogram struct {
+	counts []uint64
+	total  uint64
+	sum    int64
+}
+
+var bounds = func() []time.Duration {
+	var b []time.Duration
+	for d := float64(10 * time.Microsecond); d < float64(2*time.Minute); d *= 1.2 {
+		b = append(b, time.Duration(d))
+	}
+	return append(b, time.Duration(math.MaxInt64))
+}()
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(bounds), func(i int) bool { return bounds[i] >= d })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.total, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.total)
+}
+
+func (h *Histogram) Mean() time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&h.sum) / int64(n))
+}
+
+// 返回分位数 q (0, 1]，没有数据时返回 0
+func (h *Histogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(n)))
+	if rank == 0 {
+		rank = 1
+	}
+	var cum uint64
+	for i := range h.counts {
+		cum += atomic.LoadUint64(&h.counts[i])
+		if cum >= rank {
+			if i == len(bounds)-1 {
+				return bounds[i-1]
+			}
+			return bounds[i]
+		}
+	}
+	return bounds[len(bounds)-2]
+}
+
+// 清空计数，用于按时间窗口统计
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.total, 0)
+	atomic.StoreInt64(&h.sum, 0)
+}
@@ -0,0 +1,94 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 10:40:05
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 10:40:05
+ * @FilePath: /TinyRpcByGo/trace/exporter.go
+ */
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// span 导出接口，span 结束时调用，实现需要保证并发安全
+type Exporter interface {
+	Export(span SpanData) error
+}
+
+//-------------------------------------------------------------------------------------
+// 内存导出，便于测试时检查产生的 span
+
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+var _ Exporter = (*MemoryExporter)(nil)
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (e *MemoryExporter) Export(span SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+func (e *MemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := make([]SpanData, len(e.spans))
+	copy(spans, e.spans)
+	return spans
+}
+
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+//-------------------------------------------------------------------------------------
+// 文件导出，每个 span 一行 JSON（JSON lines）
+
+type FileExporter struct {
+	mu  sync.Mutex
+	f   *os.File
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+var _ Exporter = (*FileExporter)(nil)
+var _ io.Closer = (*FileExporter)(nil)
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	return &FileExporter{f: f, buf: buf, enc: json.NewEncoder(buf)}, nil
+}
+
+func (e *FileExporter) Export(span SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(span); err != nil {
+		return err
+	}
+	return e.buf.Flush()
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.buf.Flush()
+	return e.f.Close()
+}
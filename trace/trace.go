@@ -0,0 +1,235 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 10:12:31
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 10:12:31
+ * @FilePath: /TinyRpcByGo/trace/trace.go
+ */
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+按 W3C Trace Context 规范在请求头中传递链路信息
+traceparent: 00-<trace-id 32位十六进制>-<parent-id 16位十六进制>-<flags 2位十六进制>
+客户端把当前 span 的上下文写进 Header.Meta，服务端从中解析出父 span，再为本次调用创建子 span
+*/
+
+const TraceparentKey = "traceparent"
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte // 01 表示被采样
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+var errInvalidTraceparent = errors.New("rpc trace: invalid traceparent")
+
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	// 版本 ff 无效，未知的更高版本只解析前四段
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, errInvalidTraceparent
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, errInvalidTraceparent
+	}
+	return sc, nil
+}
+
+//-------------------------------------------------------------------------------------
+// span 的定义，结束时交给 Exporter 导出
+
+type SpanKind string
+
+const (
+	SpanKindInternal SpanKind = "internal"
+	SpanKindServer   SpanKind = "server"
+	SpanKindClient   SpanKind = "client"
+)
+
+// 导出的 span 数据，字段都是可序列化的
+type SpanData struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Kind         SpanKind          `json:"kind"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// 以下方法允许 nil 接收者，没有配置 Tracer 时调用方无需判断
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+// 结束 span 并导出，重复调用只有第一次生效
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	data := s.data
+	s.mu.Unlock()
+
+	if s.tracer.exporter != nil {
+		_ = s.tracer.exporter.Export(data)
+	}
+}
+
+//-------------------------------------------------------------------------------------
+// Tracer 负责创建 span，父 span 从 context 中获取（本地 span 或远端传来的 SpanContext）
+
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{Flags: 0x01}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+	} else {
+		_, _ = rand.Read(sc.TraceID[:])
+	}
+	_, _ = rand.Read(sc.SpanID[:])
+
+	span := &Span{
+		tracer: t,
+		sc:     sc,
+		data: SpanData{
+			Name:    name,
+			TraceID: hex.EncodeToString(sc.TraceID[:]),
+			SpanID:  hex.EncodeToString(sc.SpanID[:]),
+			Kind:    kind,
+			Start:   time.Now(),
+		},
+	}
+	if parent.IsValid() {
+		span.data.ParentSpanID = hex.EncodeToString(parent.SpanID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+//-------------------------------------------------------------------------------------
+// context 相关
+
+type spanKey struct{}
+type remoteKey struct{}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// 优先返回本地 span，其次是远端传来的 SpanContext
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// 将 ctx 中的链路信息写入请求头的 meta
+func Inject(ctx context.Context, meta map[string]string) {
+	if sc := SpanContextFromContext(ctx); sc.IsValid() {
+		meta[TraceparentKey] = sc.Traceparent()
+	}
+}
+
+// 从请求头的 meta 中取出链路信息，放进 ctx
+func Extract(ctx context.Context, meta map[string]string) context.Context {
+	s, ok := meta[TraceparentKey]
+	if !ok {
+		return ctx
+	}
+	sc, err := ParseTraceparent(s)
+	if err != nil {
+		return ctx
+	}
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
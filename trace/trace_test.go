@@ -0,0 +1,56 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:23:06
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:23:06
+ * @FilePath: /TinyRpcByGo/trace/trace_test.go
+ */
+package trace
+
+import (
+	"context"
+	"testing"
+)
+
+func TestExtractStartKeepsTraceID(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(exporter)
+
+	ctx := Extract(context.Background(), map[string]string{TraceparentKey: traceparent})
+	ctx, span := tracer.Start(ctx, "Foo.Sum", SpanKindServer)
+	span.End(nil)
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("expect 1 span, got %d", len(spans))
+	}
+	got := spans[0]
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id = %s", got.TraceID)
+	}
+	if got.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("parent span id = %s", got.ParentSpanID)
+	}
+	if got.Kind != SpanKindServer || got.Name != "Foo.Sum" {
+		t.Errorf("unexpected span %+v", got)
+	}
+
+	// 继续向下游传递时 trace id 不变，parent 换成本地 span
+	meta := make(map[string]string)
+	Inject(ctx, meta)
+	sc, err := ParseTraceparent(meta[TraceparentKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID != span.SpanContext().TraceID || sc.SpanID != span.SpanContext().SpanID {
+		t.Errorf("injected %s, want span %s", meta[TraceparentKey], span.SpanContext().Traceparent())
+	}
+}
+
+func TestExtractInvalidTraceparent(t *testing.T) {
+	ctx := Extract(context.Background(), map[string]string{TraceparentKey: "00-xyz"})
+	if SpanContextFromContext(ctx).IsValid() {
+		t.Error("invalid traceparent should be ignored")
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:23:06
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:23:06
+ * @FilePath: /TinyRpcByGo/trace_test.go
+ */
+package tinyrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"tinyrpc/trace"
+)
+
+type TraceFoo struct{}
+
+func (TraceFoo) Sum(args [2]int, reply *int) error {
+	*reply = args[0] + args[1]
+	return nil
+}
+
+// 客户端带着 traceparent 调用，服务端的 span 与调用方在同一条链路上
+func TestServerSpanPropagation(t *testing.T) {
+	exporter := trace.NewMemoryExporter()
+	server := NewServer(WithTracer(trace.NewTracer(exporter)))
+	if err := server.Register(TraceFoo{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	parent, err := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	var reply int
+	if err := client.Call(ctx, "TraceFoo.Sum", [2]int{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 3 {
+		t.Fatalf("reply = %d", reply)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("expect 1 server span, got %d", len(spans))
+	}
+	got := spans[0]
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("span not on the caller's trace: %+v", got)
+	}
+	if got.Kind != trace.SpanKindServer || got.Name != "TraceFoo.Sum" {
+		t.Errorf("unexpected span %+v", got)
+	}
+}
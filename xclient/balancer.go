@@ -0,0 +1,356 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 01:54:57
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 01:56:27
+ * @FilePath: /TinyRpcByGo/xclient/balancer.go
+ */
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 负载均衡与服务发现解耦：服务发现只负责提供服务实例，选择哪个实例由 Balancer 决定
+// 1. Update(instances) 服务实例变化时调用
+// 2. Pick(info) 为一次调用选择一个服务实例
+// 3. Feedback(addr, latency, err) 调用结束后反馈结果，可以用于调整之后的选择
+// 同一个 Balancer 会被并发调用，实现需要自己保证并发安全
+type Balancer interface {
+	Update(instances []Instance)
+	Pick(info *PickInfo) (string, error)
+	Feedback(addr string, latency time.Duration, err error)
+}
+
+// 一次选择的上下文
+type PickInfo struct {
+	Ctx           context.Context
+	ServiceMethod string
+	Args          interface{}
+	Key           string                 // 路由键，见 WithHashKey，没有时为空
+	State         ConnState              // 连接的状态，可能为空
+	Filter        func(addr string) bool // 不为空时只能选择返回 true 的实例，比如故障转移时排除已经失败的实例
+}
+
+func (info *PickInfo) allow(addr string) bool {
+	return info == nil || info.Filter == nil || info.Filter(addr)
+}
+
+// 过滤后的候选实例，没有过滤条件时直接返回 servers
+func (info *PickInfo) candidates(servers []string) []string {
+	if info == nil || info.Filter == nil {
+		return servers
+	}
+	cands := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if info.Filter(s) {
+			cands = append(cands, s)
+		}
+	}
+	return cands
+}
+
+var ErrNoAvailable = errors.New("rpc discovery: no available servers")
+
+//-------------------------------------------------------------------------------------
+// 负载均衡策略按名字注册，可以注册自定义的策略，然后通过 NewXClientWithBalancer 使用
+
+type BalancerBuilder func() Balancer
+
+var (
+	balancerMu sync.RWMutex
+	balancers  = make(map[string]BalancerBuilder)
+)
+
+// 注册负载均衡策略，同名的策略会被覆盖
+func RegisterBalancer(name string, builder BalancerBuilder) {
+	balancerMu.Lock()
+	defer balancerMu.Unlock()
+	balancers[name] = builder
+}
+
+// 根据名字创建负载均衡策略
+func NewBalancer(name string) (Balancer, error) {
+	balancerMu.RLock()
+	builder, ok := balancers[name]
+	balancerMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("rpc xclient: unknown balancer %q", name)
+	}
+	return builder(), nil
+}
+
+// 内置的负载均衡策略，与 SelectMode 一一对应
+var selectModeNames = map[SelectMode]string{
+	RandomSelect:             "random",
+	RoundRobinSelect:         "round_robin",
+	WeightedRoundRobinSelect: "weighted_round_robin",
+	ConsistentHashSelect:     "consistent_hash",
+	P2CSelect:                "p2c",
+	LeastPendingSelect:       "least_pending",
+}
+
+func (mode SelectMode) String() string {
+	if name, ok := selectModeNames[mode]; ok {
+		return name
+	}
+	return fmt.Sprintf("SelectMode(%d)", int(mode))
+}
+
+func init() {
+	RegisterBalancer(RandomSelect.String(), func() Balancer { return &randomBalancer{r: newRand()} })
+	RegisterBalancer(RoundRobinSelect.String(), func() Balancer {
+		r := newRand()
+		return &roundRobinBalancer{index: r.Intn(math.MaxInt32 - 1)}
+	})
+	RegisterBalancer(WeightedRoundRobinSelect.String(), func() Balancer {
+		return &weightedRoundRobinBalancer{current: make(map[string]int)}
+	})
+	RegisterBalancer(ConsistentHashSelect.String(), func() Balancer { return &consistentHashBalancer{} })
+	RegisterBalancer(P2CSelect.String(), func() Balancer { return &p2cBalancer{r: newRand()} })
+	RegisterBalancer(LeastPendingSelect.String(), func() Balancer { return &leastPendingBalancer{r: newRand()} })
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+func addrs(instances []Instance) []string {
+	servers := make([]string, 0, len(instances))
+	for _, ins := range instances {
+		servers = append(servers, ins.Addr)
+	}
+	return servers
+}
+
+// 不需要调用结果的策略嵌套这个结构体
+type noFeedback struct{}
+
+func (noFeedback) Feedback(string, time.Duration, error) {}
+
+//-------------------------------------------------------------------------------------
+// 随机选择
+
+type randomBalancer struct {
+	noFeedback
+	mu      sync.Mutex
+	r       *rand.Rand
+	servers []string
+}
+
+func (b *randomBalancer) Update(instances []Instance) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.servers = addrs(instances)
+}
+
+func (b *randomBalancer) Pick(info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	servers := info.candidates(b.servers)
+	if len(servers) == 0 {
+		return "", ErrNoAvailable
+	}
+	return servers[b.r.Intn(len(servers))], nil
+}
+
+//-------------------------------------------------------------------------------------
+// 轮询，index 记录已经轮询到的位置，避免每次从 0 开始，初始化时设定一个随机值
+
+type roundRobinBalancer struct {
+	noFeedback
+	mu      sync.Mutex
+	index   int
+	servers []string
+}
+
+func (b *roundRobinBalancer) Update(instances []Instance) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.servers = addrs(instances)
+}
+
+func (b *roundRobinBalancer) Pick(info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.servers)
+	for i := 0; i < n; i++ {
+		s := b.servers[b.index%n]
+		b.index = (b.index + 1) % n
+		if info.allow(s) {
+			return s, nil
+		}
+	}
+	return "", ErrNoAvailable
+}
+
+//-------------------------------------------------------------------------------------
+// 平滑加权轮询（nginx 的算法）
+// 每次选择时所有实例的 current 加上自身权重，选出 current 最大的实例，再把它的 current 减去总权重
+// 权重 {a:5, b:1, c:1} 的选择序列为 a a b a c a a，高权重的实例不会被连续集中选中
+
+type weightedRoundRobinBalancer struct {
+	noFeedback
+	mu        sync.Mutex
+	instances []Instance
+	current   map[string]int // 每个实例当前的权重
+}
+
+// 服务列表变化后加权轮询的状态重新开始
+func (b *weightedRoundRobinBalancer) Update(instances []Instance) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.instances = instances
+	b.current = make(map[string]int)
+}
+
+func (b *weightedRoundRobinBalancer) Pick(info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	best := ""
+	for _, ins := range b.instances {
+		if !info.allow(ins.Addr) {
+			continue
+		}
+		w := ins.weight()
+		b.current[ins.Addr] += w
+		total += w
+		if best == "" || b.current[ins.Addr] > b.current[best] {
+			best = ins.Addr
+		}
+	}
+	if best == "" {
+		return "", ErrNoAvailable
+	}
+	b.current[best] -= total
+	return best, nil
+}
+
+//-------------------------------------------------------------------------------------
+// 一致性哈希，相同路由键的请求落到同一个实例上，见 hash.go
+
+type consistentHashBalancer struct {
+	noFeedback
+	mu   sync.Mutex
+	ring *hashRing
+}
+
+// 服务列表变化时重建哈希环，未变化的实例上的 key 不会迁移
+func (b *consistentHashBalancer) Update(instances []Instance) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ring = newHashRing(defaultReplicas, addrs(instances))
+}
+
+func (b *consistentHashBalancer) Pick(info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ring == nil || len(b.ring.keys) == 0 {
+		return "", ErrNoAvailable
+	}
+	if info.Key == "" {
+		return "", ErrNoHashKey
+	}
+	if s := b.ring.get(info.Key, info.Filter); s != "" {
+		return s, nil
+	}
+	return "", ErrNoAvailable
+}
+
+//-------------------------------------------------------------------------------------
+// P2C（power of two choices）
+// 随机选出两个候选实例，比较 延迟的 EWMA * (在途请求数 + 1)，选择代价更小的一个
+// 慢节点（比如正在频繁 GC）的延迟升高后，流量会自动流向其他节点
+// 没有延迟样本的实例代价为 0，会被优先选中，以便尽快得到它的延迟
+// 没有连接状态时退化为随机选择
+
+type p2cBalancer struct {
+	noFeedback
+	mu      sync.Mutex
+	r       *rand.Rand
+	servers []string
+}
+
+func (b *p2cBalancer) Update(instances []Instance) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.servers = addrs(instances)
+}
+
+func (b *p2cBalancer) Pick(info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	servers := info.candidates(b.servers)
+	n := len(servers)
+	if n == 0 {
+		return "", ErrNoAvailable
+	}
+	if n == 1 {
+		return servers[0], nil
+	}
+	i := b.r.Intn(n)
+	if info.State == nil {
+		return servers[i], nil
+	}
+	j := b.r.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	load := func(addr string) float64 {
+		return float64(info.State.Latency(addr)) * float64(info.State.Pending(addr)+1)
+	}
+	if load(servers[j]) < load(servers[i]) {
+		return servers[j], nil
+	}
+	return servers[i], nil
+}
+
+//-------------------------------------------------------------------------------------
+// 选择在途请求最少的实例，数量相同的实例中等概率随机选择，没有连接状态时退化为随机选择
+
+type leastPendingBalancer struct {
+	noFeedback
+	mu      sync.Mutex
+	r       *rand.Rand
+	servers []string
+}
+
+func (b *leastPendingBalancer) Update(instances []Instance) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.servers = addrs(instances)
+}
+
+func (b *leastPendingBalancer) Pick(info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	servers := info.candidates(b.servers)
+	if len(servers) == 0 {
+		return "", ErrNoAvailable
+	}
+	if info.State == nil {
+		return servers[b.r.Intn(len(servers))], nil
+	}
+	best, min, ties := "", 0, 0
+	for _, s := range servers {
+		p := info.State.Pending(s)
+		switch {
+		case best == "" || p < min:
+			best, min, ties = s, p, 1
+		case p == min:
+			// 蓄水池抽样，第 k 个并列的实例以 1/k 的概率替换
+			ties++
+			if b.r.Intn(ties) == 0 {
+				best = s
+			}
+		}
+	}
+	return best, nil
+}
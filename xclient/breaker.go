@@ -0,0 +1,291 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 01:59:50
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:24:46
+ * @FilePath: /TinyRpcByGo/xclient/breaker.go
+ */
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+	. "tinyrpc"
+)
+
+// 每个地址一个熔断器
+// 1. 关闭：正常调用，连续失败次数或统计窗口内的错误率超过阈值时打开
+// 2. 打开：负载均衡跳过这个地址，也不再拨号，Cooldown 之后进入半开
+// 3. 半开：只放过一个探测请求，成功则关闭，失败则重新打开
+
+type BreakerConfig struct {
+	ConsecutiveFailures int                  // 连续失败多少次后打开，默认 5
+	ErrorRatio          float64              // 统计窗口内错误率达到多少后打开，0 表示不按错误率
+	MinRequests         int                  // 按错误率打开时窗口内至少需要的请求数，默认 20
+	Window              time.Duration        // 错误率的统计窗口，默认 10s
+	Cooldown            time.Duration        // 打开后多久进入半开，默认 5s
+	IsFailure           func(err error) bool // 为空时 CodeUnavailable 和 CodeDeadlineExceeded 算失败，业务错误说明服务端还活着；调用方自己的 ctx 超时或取消不会交给它判断
+}
+
+const (
+	defaultBreakerFailures    = 5
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerCooldown    = 5 * time.Second
+)
+
+// 熔断器打开时的错误，属于连接层面的错误，Failover 会换一个实例重试
+var ErrCircuitOpen = &Error{Code: CodeUnavailable, Msg: "rpc xclient: circuit breaker is open"}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// 开启熔断，零值字段使用默认值
+func WithCircuitBreaker(cfg BreakerConfig) XClientOption {
+	return func(o *xclientOptions) {
+		if cfg.ConsecutiveFailures <= 0 {
+			cfg.ConsecutiveFailures = defaultBreakerFailures
+		}
+		if cfg.MinRequests <= 0 {
+			cfg.MinRequests = defaultBreakerMinRequests
+		}
+		if cfg.Window <= 0 {
+			cfg.Window = defaultBreakerWindow
+		}
+		if cfg.Cooldown <= 0 {
+			cfg.Cooldown = defaultBreakerCooldown
+		}
+		if cfg.IsFailure == nil {
+			cfg.IsFailure = func(err error) bool {
+				code := ErrorCode(err)
+				return code == CodeUnavailable || code == CodeDeadlineExceeded
+			}
+		}
+		o.breaker = &cfg
+	}
+}
+
+type breaker struct {
+	state       BreakerState
+	consecutive int // 连续失败次数
+	requests    int // 当前窗口内的请求数
+	failures    int // 当前窗口内的失败数
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool // 半开状态下已经放过了探测请求
+	trips       int  // 累计打开的次数
+	lastErr     string
+}
+
+// 熔断器的状态，用于调试页面
+type BreakerStatus struct {
+	Addr                string       `json:"addr"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Requests            int          `json:"requests"`
+	Failures            int          `json:"failures"`
+	Trips               int          `json:"trips"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"` // 从未打开过时为空
+	LastError           string       `json:"last_error,omitempty"`
+}
+
+// 负载均衡能否选择这个地址，只判断不改变状态，调用方需持有 xc.mu
+func (xc *XClient) breakerAllow(rpcAddr string) bool {
+	cfg := xc.xopt.breaker
+	b, ok := xc.breakers[rpcAddr]
+	if cfg == nil || !ok {
+		return true
+	}
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= cfg.Cooldown
+	case BreakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// 调用前检查熔断器，冷却结束的熔断器进入半开，放过这一个探测请求
+func (xc *XClient) breakerAcquire(rpcAddr string) error {
+	cfg := xc.xopt.breaker
+	if cfg == nil {
+		return nil
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	b, ok := xc.breakers[rpcAddr]
+	if !ok {
+		return nil
+	}
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < cfg.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		xc.log().Info("rpc xclient: circuit breaker half-open", "addr", rpcAddr)
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// 调用结束后记录结果，ctx 为这次调用的 ctx
+// 调用方自己的 ctx 超时或者取消导致的失败说明不了服务端的状态，不计入统计
+func (xc *XClient) breakerRecord(ctx context.Context, rpcAddr string, err error) {
+	cfg := xc.xopt.breaker
+	if cfg == nil || err == ErrCircuitOpen {
+		return
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	b, ok := xc.breakers[rpcAddr]
+	if !ok {
+		b = &breaker{windowStart: time.Now()}
+		xc.breakers[rpcAddr] = b
+	}
+
+	now := time.Now()
+	if now.Sub(b.windowStart) >= cfg.Window {
+		b.requests, b.failures, b.windowStart = 0, 0, now
+	}
+	callerDone := err != nil && (ctx.Err() != nil || ErrorCode(err) == CodeCanceled)
+	failed := err != nil && !callerDone && cfg.IsFailure(err)
+
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		switch {
+		case failed:
+			xc.tripBreaker(rpcAddr, b, err)
+		case !callerDone:
+			// 调用方超时或者取消的请求说明不了服务端的状态，等下一个探测请求
+			b.state = BreakerClosed
+			b.consecutive, b.requests, b.failures, b.windowStart = 0, 0, 0, now
+			xc.log().Info("rpc xclient: circuit breaker closed", "addr", rpcAddr)
+		}
+		return
+	}
+
+	if callerDone {
+		return
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	b.lastErr = err.Error()
+	if b.state != BreakerClosed {
+		return
+	}
+	if b.consecutive >= cfg.ConsecutiveFailures ||
+		(cfg.ErrorRatio > 0 && b.requests >= cfg.MinRequests && float64(b.failures)/float64(b.requests) >= cfg.ErrorRatio) {
+		xc.tripBreaker(rpcAddr, b, err)
+	}
+}
+
+// 打开熔断器，调用方需持有 xc.mu
+func (xc *XClient) tripBreaker(rpcAddr string, b *breaker, err error) {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.trips++
+	b.lastErr = err.Error()
+	xc.log().Warn("rpc xclient: circuit breaker open", "addr", rpcAddr, "consecutive_failures", b.consecutive,
+		"requests", b.requests, "failures", b.failures, "code", ErrorCode(err), "err", err)
+	// 连接已经不可用了，关掉缓存的 Client，熔断期间也不再拨号
+	if client, ok := xc.clients[rpcAddr]; ok && !client.IsAvailable() {
+		_ = client.Close()
+		delete(xc.clients, rpcAddr)
+	}
+}
+
+// 返回所有地址的熔断器状态，按地址排序
+func (xc *XClient) Breakers() []BreakerStatus {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	status := make([]BreakerStatus, 0, len(xc.breakers))
+	for addr, b := range xc.breakers {
+		var openedAt *time.Time
+		if b.trips > 0 {
+			t := b.openedAt
+			openedAt = &t
+		}
+		status = append(status, BreakerStatus{
+			Addr:                addr,
+			State:               b.state,
+			ConsecutiveFailures: b.consecutive,
+			Requests:            b.requests,
+			Failures:            b.failures,
+			Trips:               b.trips,
+			OpenedAt:            openedAt,
+			LastError:           b.lastErr,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Addr < status[j].Addr })
+	return status
+}
+
+//-------------------------------------------------------------------------------------
+// XClient 在服务端的调试页面上展示自己的状态，见 tinyrpc.RegisterDebugSection
+
+var xclientID uint64
+
+type xclientDebug struct {
+	Breakers []BreakerStatus `json:"breakers,omitempty"`
+	Outliers []OutlierStatus `json:"outliers,omitempty"`
+}
+
+// 设置 XClient 在调试页面上的名字，默认为 xclient-<序号>
+func WithName(name string) XClientOption {
+	return func(o *xclientOptions) {
+		o.name = name
+	}
+}
+
+func (xc *XClient) newDebugName() string {
+	if xc.xopt.name != "" {
+		return xc.xopt.name
+	}
+	return fmt.Sprintf("xclient-%d", atomic.AddUint64(&xclientID, 1))
+}
+
+func (xc *XClient) debugInfo() interface{} {
+	info := xclientDebug{}
+	if xc.xopt.breaker != nil {
+		info.Breakers = xc.Breakers()
+	}
+	if xc.xopt.outlier != nil {
+		info.Outliers = xc.Outliers()
+	}
+	return info
+}
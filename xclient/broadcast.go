@@ -0,0 +1,126 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:01:31
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:07:55
+ * @FilePath: /TinyRpcByGo/xclient/broadcast.go
+ */
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// BroadcastAll 的每个服务端的结果
+type BroadcastResult struct {
+	Addr  string
+	Reply interface{} // 与传入的 reply 类型相同的新指针，失败时为空
+	Err   error
+}
+
+type BroadcastOption func(*broadcastOptions)
+
+type broadcastOptions struct {
+	quorum     int
+	bestEffort bool
+	timeout    time.Duration
+}
+
+// 有 n 个服务端成功后立即返回，取消其余的请求；失败的数量多到不可能达到 n 个成功时也立即返回
+func WithQuorum(n int) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.quorum = n
+	}
+}
+
+// 尽力而为，部分服务端失败时也不返回错误，由调用方检查每个结果
+func WithBestEffort() BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.bestEffort = true
+	}
+}
+
+// 整个广播的超时时间，超时还没有返回的服务端结果为 deadline exceeded
+func WithBroadcastTimeout(d time.Duration) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.timeout = d
+	}
+}
+
+// 向提供这个服务的所有服务端广播调用，返回每个服务端的结果，顺序与服务发现返回的实例相同
+// reply 只用于确定结果的类型，每个服务端的结果解码到各自新建的 reply 中，可以为空
+// 默认等待所有服务端返回，有失败时返回错误；WithQuorum 时达到法定数量即成功；WithBestEffort 时不返回调用失败的错误
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, opts ...BroadcastOption) ([]BroadcastResult, error) {
+	var bo broadcastOptions
+	for _, opt := range opts {
+		opt(&bo)
+	}
+
+	servers, err := xc.servers(ctx, serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, ErrNoAvailable
+	}
+	if bo.quorum > len(servers) {
+		return nil, fmt.Errorf("rpc xclient: broadcast quorum %d is more than %d servers", bo.quorum, len(servers))
+	}
+
+	if bo.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bo.timeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]BroadcastResult, len(servers))
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+		failed    int
+	)
+	for i, rpcAddr := range servers {
+		wg.Add(1)
+		go func(i int, rpcAddr string) {
+			defer wg.Done()
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = BroadcastResult{Addr: rpcAddr, Err: err}
+			if err != nil {
+				failed++
+			} else {
+				results[i].Reply = clonedReply
+				succeeded++
+			}
+			// 法定数量已经达到，或者已经不可能达到，取消其余的请求
+			if bo.quorum > 0 && (succeeded >= bo.quorum || len(servers)-failed < bo.quorum) {
+				cancel()
+			}
+		}(i, rpcAddr)
+	}
+	wg.Wait()
+
+	switch {
+	case bo.quorum > 0:
+		if succeeded < bo.quorum {
+			return results, fmt.Errorf("rpc xclient: broadcast quorum not reached: %d of %d succeeded, need %d",
+				succeeded, len(servers), bo.quorum)
+		}
+	case failed > 0 && !bo.bestEffort:
+		return results, fmt.Errorf("rpc xclient: broadcast: %d of %d servers failed", failed, len(servers))
+	}
+	return results, nil
+}
@@ -0,0 +1,79 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 01:53:29
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 01:53:29
+ * @FilePath: /TinyRpcByGo/xclient/connstate.go
+ */
+package xclient
+
+import (
+	"math"
+	"time"
+	. "tinyrpc"
+)
+
+// XClient 根据缓存的 Client 和调用结果提供连接的状态，负载均衡策略据此选择实例
+
+const (
+	latencyDecay   = 10 * time.Second // EWMA 的衰减时间，越久之前的延迟样本权重越小
+	latencyPenalty = time.Second      // 连接不可用或超时时记入的延迟惩罚
+)
+
+var _ ConnState = (*XClient)(nil)
+
+// 每个地址的延迟统计，保存在 XClient 中，连接重建后依然保留
+type addrStat struct {
+	ewma float64 // 延迟的指数加权移动平均，单位纳秒，0 表示还没有样本
+	last time.Time
+}
+
+// 记录一次调用的结果，调用方需持有 xc.mu
+func (s *addrStat) observe(latency time.Duration, err error) {
+	if code := ErrorCode(err); code == CodeUnavailable || code == CodeDeadlineExceeded {
+		if latency < latencyPenalty {
+			latency = latencyPenalty
+		}
+	}
+	now := time.Now()
+	if s.ewma == 0 {
+		s.ewma = float64(latency)
+	} else {
+		w := math.Exp(-float64(now.Sub(s.last)) / float64(latencyDecay))
+		s.ewma = s.ewma*w + float64(latency)*(1-w)
+	}
+	s.last = now
+}
+
+// 调用结束后更新地址的延迟统计
+func (xc *XClient) observe(rpcAddr string, latency time.Duration, err error) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	s, ok := xc.stats[rpcAddr]
+	if !ok {
+		s = &addrStat{}
+		xc.stats[rpcAddr] = s
+	}
+	s.observe(latency, err)
+}
+
+// 缓存的连接上还未收到响应的请求数
+func (xc *XClient) Pending(rpcAddr string) int {
+	xc.mu.Lock()
+	client, ok := xc.clients[rpcAddr]
+	xc.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return client.Pending()
+}
+
+// 地址延迟的 EWMA
+func (xc *XClient) Latency(rpcAddr string) time.Duration {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if s, ok := xc.stats[rpcAddr]; ok {
+		return time.Duration(s.ewma)
+	}
+	return 0
+}
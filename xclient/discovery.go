@@ -8,96 +8,292 @@
 package xclient
 
 import (
-	"errors"
-	"math"
-	"math/rand"
+	"context"
+	"log/slog"
 	"sync"
 	"time"
+	"tinyrpc"
 )
 
 //假设有多个服务实例，每个实例提供相同的功能
 //为了提高整个系统的吞吐量，每个实例部署在不同的机器上。
 //客户端可以选择任意一个实例进行调用，获取想要的结果。
 
+// 负载均衡策略，每种策略对应一个内置的 Balancer，见 balancer.go
 type SelectMode int
 
 const (
 	RandomSelect SelectMode = iota
 	RoundRobinSelect
+	WeightedRoundRobinSelect // 平滑加权轮询，权重来自服务实例的元数据
+	ConsistentHashSelect     // 一致性哈希，按调用的路由键选择实例
+	P2CSelect                // 两个随机候选中选择延迟和在途请求更少的实例
+	LeastPendingSelect       // 选择在途请求最少的实例，数量相同时随机选择
 )
 
-// 发现服务的接口
+// 连接的状态，由 XClient 根据缓存的 Client 提供给负载均衡策略
+// 1. Pending(addr) 该地址上还未收到响应的请求数，没有连接时为 0
+// 2. Latency(addr) 该地址延迟的 EWMA，没有样本时为 0
+type ConnState interface {
+	Pending(addr string) int
+	Latency(addr string) time.Duration
+}
+
+// 服务实例，Addr 的格式同 XDial: protocol@addr
+// 注册中心和 etcd 中以 JSON 保存，字段与 registry.ServerItem 保持一致
+// 除了 Addr 都是可选的元数据，可以通过 WithSelector 按元数据选择实例
+type Instance struct {
+	Addr     string
+	Service  string            `json:",omitempty"` // 提供的服务名，为空表示提供所有服务
+	Weight   int               `json:",omitempty"` // 加权轮询的权重，不大于 0 时按 1 处理
+	Version  string            `json:",omitempty"` // 服务的版本
+	Zone     string            `json:",omitempty"` // 所在的可用区
+	Protocol string            `json:",omitempty"` // 同 XDial 中的 protocol，Addr 没有带 protocol@ 时补在 Addr 前面
+	Tags     map[string]string `json:",omitempty"` // 其他自定义的标签
+}
+
+// 按名字取元数据，version、zone、protocol、service 对应同名的字段，其他的从 Tags 中取
+func (ins Instance) Tag(key string) (string, bool) {
+	switch key {
+	case "version":
+		return ins.Version, ins.Version != ""
+	case "zone":
+		return ins.Zone, ins.Zone != ""
+	case "protocol":
+		return ins.Protocol, ins.Protocol != ""
+	case "service":
+		return ins.Service, ins.Service != ""
+	}
+	v, ok := ins.Tags[key]
+	return v, ok
+}
+
+func (ins Instance) equal(other Instance) bool {
+	if ins.Addr != other.Addr || ins.Service != other.Service || ins.Weight != other.Weight ||
+		ins.Version != other.Version || ins.Zone != other.Zone || ins.Protocol != other.Protocol ||
+		len(ins.Tags) != len(other.Tags) {
+		return false
+	}
+	for k, v := range ins.Tags {
+		if w, ok := other.Tags[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Addr 与 Protocol 保持一致，Addr 总是 protocol@addr 的格式，见 tinyrpc.NormalizeAddr
+// 注册中心已经统一过一次，这里处理不经过注册中心的实例：静态配置、文件、DNS 以及直接写入 etcd 的实例
+func (ins *Instance) normalize() {
+	ins.Addr, ins.Protocol = tinyrpc.NormalizeAddr(ins.Addr, ins.Protocol)
+}
+
+func (ins Instance) weight() int {
+	if ins.Weight <= 0 {
+		return 1
+	}
+	return ins.Weight
+}
+
+// 发现服务的接口，只负责提供服务实例，负载均衡由 Balancer 完成
 //1. Refresh() 从注册中心更新到服务列表
 //2. Update(servers interface{}) 手动更新某个服务到服务列表
-//3. Get(mode SelectMode) 根据负载均衡策略，选择一个服务实例
-//4. GetAll() ([]string, error) 返回所有服务实例
+//3. GetAll() ([]string, error) 返回所有服务实例
+//4. GetInstances() ([]Instance, error) 返回所有服务实例及其元数据
+//5. GetServiceInstances(service string) ([]Instance, error) 只返回提供 service 服务的实例
+//6. Watch(ctx context.Context) <-chan []Instance 订阅服务实例的变化，先收到当前的实例列表，之后每次变化收到完整的新列表
+// 同一个地址注册了多个服务时，返回的列表中每个地址只出现一次
 type Discoery interface {
 	Refresh() error
 	Update(servers []string) error
-	Get(mode SelectMode) (string, error)
 	GetAll() ([]string, error)
+	GetInstances() ([]Instance, error)
+	GetServiceInstances(service string) ([]Instance, error)
+	Watch(ctx context.Context) <-chan []Instance
 }
 
 // 用于发现服务的结构体
-// 1. r 产生的随机数
-// 2. index记录RoundRobin算法已经轮询到的位置，避免每次从0开始，初始化设定一个值
+// balancers 是 Get 使用的内置负载均衡策略，按需创建，服务列表变化时更新
+// watchers 是通过 Watch 订阅的 channel，服务列表变化时通知
 type MultiServersDiscovery struct {
-	r       *rand.Rand
-	mu      sync.RWMutex
-	servers []string
-	index   int
+	mu        sync.RWMutex
+	instances []Instance
+	logger    *slog.Logger
+	balancers map[SelectMode]Balancer
+	watchers  map[chan []Instance]struct{}
 }
 
 var _ Discoery = (*MultiServersDiscovery)(nil)
 
 func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	d := &MultiServersDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		balancers: make(map[SelectMode]Balancer),
+		watchers:  make(map[chan []Instance]struct{}),
 	}
-
-	d.index = d.r.Intn(math.MaxInt32 - 1)
+	d.setServers(servers)
 	return d
 }
 
-func (d *MultiServersDiscovery) Refresh() error {
-	return nil
+// 静态配置带权重的服务实例
+func NewInstanceDiscovery(instances []Instance) *MultiServersDiscovery {
+	d := NewMultiServerDiscovery(nil)
+	d.setInstances(instances)
+	return d
 }
 
-func (d *MultiServersDiscovery) Update(servers []string) error {
+// 更新服务实例及其权重
+func (d *MultiServersDiscovery) UpdateInstances(instances []Instance) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setInstances(instances)
 	return nil
 }
 
-func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
+// 调用方需持有锁
+func (d *MultiServersDiscovery) setInstances(instances []Instance) {
+	for i := range instances {
+		instances[i].normalize()
+	}
+	old := serviceInstances(d.instances, "")
+	d.instances = instances
+	cur := serviceInstances(instances, "")
+	for _, b := range d.balancers {
+		b.Update(cur)
+	}
+	if !sameInstances(old, cur) {
+		d.notify(cur)
+	}
+}
+
+// 调用方需持有锁
+// 每个订阅方只缓存一个列表，订阅方处理不及时时丢掉旧的列表，只保留最新的
+func (d *MultiServersDiscovery) notify(instances []Instance) {
+	for ch := range d.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- append([]Instance(nil), instances...)
+	}
+}
+
+// 订阅服务实例的变化，ctx 结束后 channel 被关闭
+// 嵌套了 MultiServersDiscovery 的服务发现只要通过 setInstances 更新服务列表，订阅方就能收到
+func (d *MultiServersDiscovery) Watch(ctx context.Context) <-chan []Instance {
+	ch := make(chan []Instance, 1)
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	d.watchers[ch] = struct{}{}
+	ch <- serviceInstances(d.instances, "")
+	d.mu.Unlock()
 
-	n := len(d.servers)
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		delete(d.watchers, ch)
+		close(ch)
+		d.mu.Unlock()
+	}()
+	return ch
+}
 
-	if n == 0 {
-		return "", errors.New("rpc discovery: no available servers")
+// 每 interval 刷新一次，直到 ctx 结束，用于需要主动拉取的服务发现
+// 不会立即刷新，调用方在开始轮询前自己刷新一次
+func pollRefresh(ctx context.Context, interval time.Duration, refresh func() error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			_ = refresh()
+		}
 	}
+}
+
+// 返回提供 service 服务的实例，没有服务名的实例提供所有服务，service 为空时返回所有实例
+// 同一个地址只保留第一次出现的实例
+func serviceInstances(instances []Instance, service string) []Instance {
+	result := make([]Instance, 0, len(instances))
+	seen := make(map[string]bool, len(instances))
+	for _, ins := range instances {
+		if service != "" && ins.Service != "" && ins.Service != service {
+			continue
+		}
+		if seen[ins.Addr] {
+			continue
+		}
+		seen[ins.Addr] = true
+		result = append(result, ins)
+	}
+	return result
+}
+
+// 调用方需持有锁
+func (d *MultiServersDiscovery) setServers(servers []string) {
+	instances := make([]Instance, 0, len(servers))
+	for _, s := range servers {
+		instances = append(instances, Instance{Addr: s})
+	}
+	d.setInstances(instances)
+}
+
+// 设置日志，嵌套了 MultiServersDiscovery 的服务发现都可以使用，为空时使用 slog.Default()
+func (d *MultiServersDiscovery) SetLogger(logger *slog.Logger) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logger = logger
+}
+
+// 调用方需持有锁
+func (d *MultiServersDiscovery) log() *slog.Logger {
+	if d.logger != nil {
+		return d.logger
+	}
+	return slog.Default()
+}
+
+func (d *MultiServersDiscovery) Refresh() error {
+	return nil
+}
 
-	switch mode {
-	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
-	case RoundRobinSelect:
-		s := d.servers[d.index%n]
-		d.index = (d.index + 1) % n
-		return s, nil
-	default:
-		return "", errors.New("rpc dicovery: not support this select mode")
+func (d *MultiServersDiscovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setServers(servers)
+	return nil
+}
+
+// 使用内置的负载均衡策略选择一个服务实例，state 为空时看不到连接的状态
+// XClient 不再使用这个方法，保留给直接使用服务发现的调用方
+func (d *MultiServersDiscovery) Get(mode SelectMode, state ConnState) (string, error) {
+	d.mu.Lock()
+	b, ok := d.balancers[mode]
+	if !ok {
+		var err error
+		if b, err = NewBalancer(mode.String()); err != nil {
+			d.mu.Unlock()
+			return "", err
+		}
+		b.Update(serviceInstances(d.instances, ""))
+		d.balancers[mode] = b
 	}
+	d.mu.Unlock()
+	return b.Pick(&PickInfo{State: state})
 }
 
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	servers := make([]string, len(d.servers))
+	return addrs(serviceInstances(d.instances, "")), nil
+}
 
-	copy(servers, d.servers)
-	return servers, nil
+func (d *MultiServersDiscovery) GetInstances() ([]Instance, error) {
+	return d.GetServiceInstances("")
+}
+
+func (d *MultiServersDiscovery) GetServiceInstances(service string) ([]Instance, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return serviceInstances(d.instances, service), nil
 }
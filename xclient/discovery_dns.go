@@ -0,0 +1,188 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:13:15
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:45:42
+ * @FilePath: /TinyRpcByGo/xclient/discovery_dns.go
+ */
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-------------------------------------------------------------------------------------
+// 基于 DNS 的服务发现，如 Kubernetes 的 headless service
+// target 有两种格式：
+// 1. host:port                  查询 host 的 A/AAAA 记录，每个 IP 一个实例
+// 2. _service._proto.name       查询 SRV 记录，端口来自 SRV，目标主机再查询 A/AAAA 记录
+// 实例的地址为 tcp@ip:port，可以直接交给 XDial
+// SRV 的 priority 越小越优先，weight 越大流量越多，映射为实例的权重：
+// 同一个 priority 内权重为 weight（0 按 1 处理），每低一级 priority 的权重缩小 srvPriorityScale 倍
+// 原始的 priority 记在标签 priority 中，需要严格按 priority 选择时使用 WithSelector("priority=10")
+// 后台每 interval 查询一次，查询失败或者没有记录时保留原来的列表
+
+// DNS 查询，*net.Resolver 实现了这个接口
+// 测试时可以使用 PreferGo 并且 Dial 指向本地假 DNS 服务器的 net.Resolver
+type DNSResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+var _ DNSResolver = (*net.Resolver)(nil)
+
+type DNSDiscovery struct {
+	*MultiServersDiscovery
+	target   string
+	srv      bool // target 是否是 SRV 记录
+	resolver DNSResolver
+	interval time.Duration
+	cancel   func()
+	// 后台查询和调用方的 Refresh 可能同时进行，查询和更新列表整体串行，避免先发出的查询后更新，用旧的结果覆盖新的
+	// 查询期间不持有 mu，不阻塞选择实例
+	refreshMu sync.Mutex
+}
+
+const (
+	defaultDNSInterval = time.Second * 30
+	dnsLookupTimeout   = time.Second * 5
+	srvPriorityScale   = 100
+	srvPriorityTiers   = 3 // 只区分最优先的 3 级 priority，更低的按第 3 级处理
+)
+
+// resolver 为空时使用 net.DefaultResolver，target 格式错误时返回错误
+// 创建时查询一次，查询失败时服务列表为空，等待下一次查询
+func NewDNSDiscovery(target string, interval time.Duration, resolver DNSResolver) (*DNSDiscovery, error) {
+	srv := strings.HasPrefix(target, "_")
+	if !srv {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("rpc discovery: invalid dns target %q: %v", target, err)
+		}
+	}
+	if interval <= 0 {
+		interval = defaultDNSInterval
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	d := &DNSDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(nil),
+		target:                target,
+		srv:                   srv,
+		resolver:              resolver,
+		interval:              interval,
+	}
+	_ = d.Refresh()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	go pollRefresh(ctx, interval, d.Refresh)
+	return d, nil
+}
+
+// 立即查询一次
+func (d *DNSDiscovery) Refresh() error {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	instances, err := d.lookup()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil && len(instances) == 0 {
+		err = fmt.Errorf("rpc discovery: no dns records for %s", d.target)
+	}
+	if err != nil {
+		d.log().Error("rpc discovery: dns lookup error, keep the old servers", "target", d.target, "err", err)
+		return err
+	}
+	d.log().Debug("rpc discovery: dns lookup", "target", d.target, "servers", len(instances))
+	d.setInstances(instances)
+	return nil
+}
+
+func (d *DNSDiscovery) lookup() ([]Instance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	if d.srv {
+		return d.lookupSRV(ctx)
+	}
+
+	host, port, _ := net.SplitHostPort(d.target)
+	ips, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]Instance, 0, len(ips))
+	for _, ip := range ips {
+		instances = append(instances, Instance{Addr: "tcp@" + net.JoinHostPort(ip, port)})
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Addr < instances[j].Addr })
+	return instances, nil
+}
+
+func (d *DNSDiscovery) lookupSRV(ctx context.Context) ([]Instance, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.target)
+	if err != nil {
+		return nil, err
+	}
+
+	// 不同的 priority 从小到大排列，下标即为优先级
+	var priorities []uint16
+	for _, rec := range records {
+		priorities = append(priorities, rec.Priority)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	tiers := make(map[uint16]int)
+	for _, p := range priorities {
+		if _, ok := tiers[p]; !ok {
+			tiers[p] = len(tiers)
+		}
+	}
+	n := len(tiers)
+	if n > srvPriorityTiers {
+		n = srvPriorityTiers
+	}
+
+	var instances []Instance
+	for _, rec := range records {
+		weight := int(rec.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		tier := tiers[rec.Priority]
+		if tier > n-1 {
+			tier = n - 1
+		}
+		for i := tier; i < n-1; i++ {
+			weight *= srvPriorityScale
+		}
+
+		host := strings.TrimSuffix(rec.Target, ".")
+		port := strconv.Itoa(int(rec.Port))
+		// 目标主机查询失败时保留主机名，由 XDial 时再解析
+		ips, err := d.resolver.LookupHost(ctx, host)
+		if err != nil || len(ips) == 0 {
+			ips = []string{host}
+		}
+		for _, ip := range ips {
+			instances = append(instances, Instance{
+				Addr:   "tcp@" + net.JoinHostPort(ip, port),
+				Weight: weight,
+				Tags:   map[string]string{"priority": strconv.Itoa(int(rec.Priority))},
+			})
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Addr < instances[j].Addr })
+	return instances, nil
+}
+
+func (d *DNSDiscovery) Close() error {
+	d.cancel()
+	return nil
+}
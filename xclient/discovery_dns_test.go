@@ -0,0 +1,129 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:45:42
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:45:42
+ * @FilePath: /TinyRpcByGo/xclient/discovery_dns_test.go
+ */
+package xclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+// 返回固定记录的 DNSResolver，hosts 中没有的主机查询失败
+type fakeResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	srv   []*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return name, r.srv, nil
+}
+
+func (r *fakeResolver) setErr(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+}
+
+func TestDNSDiscoverySRVWeights(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{
+			"a.example": {"10.0.0.2", "10.0.0.1"},
+			"b.example": {"10.0.0.3"},
+			"c.example": {"10.0.0.4"},
+			"e.example": {"10.0.0.5"},
+		},
+		srv: []*net.SRV{
+			{Target: "a.example.", Port: 8001, Priority: 10, Weight: 5},
+			{Target: "b.example.", Port: 8002, Priority: 10, Weight: 0},
+			{Target: "c.example.", Port: 8003, Priority: 20, Weight: 3},
+			{Target: "d.example.", Port: 8004, Priority: 30, Weight: 2},
+			{Target: "e.example.", Port: 8005, Priority: 40, Weight: 1},
+		},
+	}
+	d, err := NewDNSDiscovery("_rpc._tcp.example", 0, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// 最优先的一级乘 100*100，第二级乘 100，第三级及更低的不变；weight 为 0 按 1 处理
+	// d.example 查询不到 IP，保留主机名
+	want := []struct {
+		addr     string
+		weight   int
+		priority string
+	}{
+		{"tcp@10.0.0.1:8001", 50000, "10"},
+		{"tcp@10.0.0.2:8001", 50000, "10"},
+		{"tcp@10.0.0.3:8002", 10000, "10"},
+		{"tcp@10.0.0.4:8003", 300, "20"},
+		{"tcp@10.0.0.5:8005", 1, "40"},
+		{"tcp@d.example:8004", 2, "30"},
+	}
+	got, err := d.GetInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expect %d instances, got %+v", len(want), got)
+	}
+	for i, w := range want {
+		priority, _ := got[i].Tag("priority")
+		if got[i].Addr != w.addr || got[i].Weight != w.weight || priority != w.priority {
+			t.Errorf("instance %d = %+v, want %+v", i, got[i], w)
+		}
+	}
+}
+
+func TestDNSDiscoveryHostKeepsOldOnError(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{"svc.example": {"10.0.0.2", "10.0.0.1"}}}
+	d, err := NewDNSDiscovery("svc.example:9999", 0, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	servers, _ := d.GetAll()
+	if len(servers) != 2 || servers[0] != "tcp@10.0.0.1:9999" || servers[1] != "tcp@10.0.0.2:9999" {
+		t.Fatalf("unexpected servers %v", servers)
+	}
+
+	r.setErr(errors.New("dns down"))
+	if err := d.Refresh(); err == nil {
+		t.Error("expect lookup error")
+	}
+	if servers, _ := d.GetAll(); len(servers) != 2 {
+		t.Errorf("lookup error should keep the old servers, got %v", servers)
+	}
+
+	if _, err := NewDNSDiscovery("svc.example", 0, r); err == nil {
+		t.Error("expect error for target without port")
+	}
+}
@@ -9,21 +9,40 @@ package xclient
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"log/slog"
+	"sort"
 	"time"
 	"tinyrpc/config"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+// 服务发现用到的 etcd 客户端方法，*clientv3.Client 实现了这个接口，测试时可以替换
+type etcdClient interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+	Close() error
+}
+
+var _ etcdClient = (*clientv3.Client)(nil)
+
 type EtcdRegistryDiscory struct {
-	*TinyRegistryDiscory                  // 继承
-	client               *clientv3.Client // 我们自己的注册中心是个http服务，而etcd就唯一一个连接
-	timeout              time.Duration    // 服务列表的过期时间
-	lastUpdate           time.Time        // 上一次从注册中心拉取服务的时间
-	cancelWatch          func()           // 取消监听协程
+	*TinyRegistryDiscory                     // 继承
+	client               etcdClient          // 我们自己的注册中心是个http服务，而etcd就唯一一个连接
+	timeout              time.Duration       // 服务列表的过期时间
+	lastUpdate           time.Time           // 上一次从注册中心拉取服务的时间
+	cancelWatch          func()              // 取消监听协程
+	items                map[string]Instance // key 为 etcd 中的 key，由监听到的事件增量更新
+	revision             int64               // 已经同步到的 etcd revision，为 0 时需要全量同步
+	synced               bool                // 监听正常时服务列表总是最新的，Refresh 不再全量拉取
 }
 
+const (
+	etcdWatchRetryInterval = time.Second     // 监听出错后重新监听前等待的时间
+	etcdRequestTimeout     = time.Second * 5 // 全量拉取的超时，etcd 不可用时不会一直阻塞调用方
+)
+
 //new一个构造函数
 
 func NewEtcdRegistryDiscory(addr string, timeout time.Duration) *EtcdRegistryDiscory {
@@ -37,14 +56,18 @@ func NewEtcdRegistryDiscory(addr string, timeout time.Duration) *EtcdRegistryDis
 	})
 
 	if err != nil {
-		log.Println("rpc discovery_etcd cannot connect: %s:%s", addr, err.Error())
+		slog.Default().Error("rpc discovery: cannot connect to etcd", "addr", addr, "err", err)
 		return nil
 	}
+	return newEtcdRegistryDiscory(addr, client, timeout)
+}
 
+func newEtcdRegistryDiscory(addr string, client etcdClient, timeout time.Duration) *EtcdRegistryDiscory {
 	etcd := &EtcdRegistryDiscory{
 		TinyRegistryDiscory: NewTinyRegistryDiscovery(addr, timeout),
 		client:              client,
 		timeout:             timeout,
+		items:               make(map[string]Instance),
 	}
 	ctx, cancelfunc := context.WithCancel(context.Background())
 	etcd.cancelWatch = cancelfunc
@@ -53,56 +76,166 @@ func NewEtcdRegistryDiscory(addr string, timeout time.Duration) *EtcdRegistryDis
 
 }
 
+// 监听 EtcdProviderPath 下的变化，增量地应用 PUT 和 DELETE 事件
+// 1. 还没有同步过时先全量拉取，从拉取时的 revision 之后开始监听，中间的变化不会丢失
+// 2. 监听出错时从已经同步到的 revision 之后继续监听
+// 3. 需要的 revision 已经被压缩时，只能重新全量拉取
+// 监听没有正常进行时 Refresh 退回到按 timeout 全量拉取
+// 每次监听使用单独的 ctx，结束监听时取消，重新监听时不会遗留旧的监听
 func (e *EtcdRegistryDiscory) watchProviders(ctx context.Context) {
-	watchChan := clientv3.NewWatcher(e.client).Watch(context.TODO(), config.EtcdProviderPath, clientv3.WithPrefix())
+	for {
+		e.mu.Lock()
+		rev := e.revision
+		e.mu.Unlock()
+		var err error
+		if rev == 0 {
+			rev, err = e.refreshFromEtcd(ctx)
+		}
+		e.mu.Lock()
+		e.synced = err == nil
+		e.mu.Unlock()
 
-	select {
-	case <-watchChan:
-		for _ = range watchChan {
-			// 这里可以做得更精细，因为 etcd 会给出变化的 key，我们权且简单处理
-			// 结点产生了变化，就从服务器拉取
+		if err == nil {
+			wctx, wcancel := context.WithCancel(ctx)
+			watchChan := e.client.Watch(wctx, config.EtcdProviderPath, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+			for resp := range watchChan {
+				if resp.CompactRevision != 0 {
+					e.log().Warn("rpc discovery: etcd watch compacted, resync", "revision", rev, "compact_revision", resp.CompactRevision)
+					e.mu.Lock()
+					e.revision = 0
+					e.mu.Unlock()
+					break
+				}
+				if err := resp.Err(); err != nil {
+					e.log().Warn("rpc discovery: etcd watch error", "revision", rev, "err", err)
+					break
+				}
+				e.mu.Lock()
+				e.applyEvents(resp.Events)
+				if resp.Header.Revision > e.revision {
+					e.revision = resp.Header.Revision
+				}
+				rev = e.revision
+				e.mu.Unlock()
+			}
+			wcancel()
+		}
+
+		e.mu.Lock()
+		e.synced = false
+		e.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(etcdWatchRetryInterval):
 		}
-		e.refreshFromEtcd()
-	case <-ctx.Done():
 	}
 }
 
+// 调用方需持有锁
+func (e *EtcdRegistryDiscory) applyEvents(events []*clientv3.Event) {
+	if len(events) == 0 {
+		return
+	}
+	for _, ev := range events {
+		key := string(ev.Kv.Key)
+		switch ev.Type {
+		case clientv3.EventTypePut:
+			ins := parseEtcdInstance(ev.Kv.Value)
+			e.log().Debug("rpc discovery: server put", "key", key, "addr", ins.Addr)
+			e.items[key] = ins
+		case clientv3.EventTypeDelete:
+			e.log().Debug("rpc discovery: server deleted", "key", key)
+			delete(e.items, key)
+		}
+	}
+	e.applyItems()
+}
+
+// 调用方需持有锁，按 key 排序后更新服务列表，保证相同的内容得到相同的列表
+func (e *EtcdRegistryDiscory) applyItems() {
+	keys := make([]string, 0, len(e.items))
+	for key := range e.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	instances := make([]Instance, 0, len(keys))
+	for _, key := range keys {
+		instances = append(instances, e.items[key])
+	}
+	e.setInstances(instances)
+	e.lastUpdate = time.Now()
+}
+
 //重写服务发现的接口方法
 
 func (e *EtcdRegistryDiscory) Refresh() error {
 	e.mu.Lock()
-	defer e.mu.Unlock()
-
-	if e.lastUpdate.Add(e.timeout).After(time.Now()) {
+	fresh := e.synced || e.lastUpdate.Add(e.timeout).After(time.Now())
+	e.mu.Unlock()
+	if fresh {
 		return nil
 	}
 
-	log.Println("rpc&&etcd discorvery: refresh providers from regitry")
-	return e.refreshFromEtcd()
+	e.log().Debug("rpc discovery: refresh servers from etcd")
+	_, err := e.refreshFromEtcd(context.Background())
+	return err
 }
 
-func (e *EtcdRegistryDiscory) refreshFromEtcd() error {
-	resp, err := e.client.Get(context.Background(), config.EtcdProviderPath, clientv3.WithPrefix())
-
+// 全量拉取并记下 revision，返回同步到的 revision
+// 拉取时不持有锁，不阻塞选择实例；拉取到的 revision 比已经同步到的旧时丢弃，不覆盖监听到的新变化
+func (e *EtcdRegistryDiscory) refreshFromEtcd(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdRequestTimeout)
+	defer cancel()
+	resp, err := e.client.Get(ctx, config.EtcdProviderPath, clientv3.WithPrefix())
 	if err != nil {
-		log.Println("rpc&&etcd discovery: refresh err:", err)
-		return err
+		e.log().Error("rpc discovery: refresh from etcd error", "err", err)
+		return 0, err
 	}
 
-	e.servers = make([]string, 0, resp.Count)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if resp.Header.Revision < e.revision {
+		return e.revision, nil
+	}
+	e.items = make(map[string]Instance, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		e.items[string(kv.Key)] = parseEtcdInstance(kv.Value)
+	}
+	e.revision = resp.Header.Revision
+	e.applyItems()
+	return e.revision, nil
+}
 
-	for i, _ := range resp.Kvs {
-		e.servers = append(e.servers, string(resp.Kvs[i].Value))
+// etcd 中的值是 JSON 格式的实例，兼容只保存了地址的旧格式
+func parseEtcdInstance(value []byte) Instance {
+	var ins Instance
+	if len(value) > 0 && value[0] == '{' && json.Unmarshal(value, &ins) == nil {
+		return ins
 	}
-	e.lastUpdate = time.Now()
-	return nil
+	return Instance{Addr: string(value)}
 }
 
-func (e *EtcdRegistryDiscory) Get(mode SelectMode) (string, error) {
+func (e *EtcdRegistryDiscory) Get(mode SelectMode, state ConnState) (string, error) {
 	if err := e.Refresh(); err != nil {
 		return "", err
 	}
-	return e.MultiServersDiscovery.Get(mode)
+	return e.MultiServersDiscovery.Get(mode, state)
+}
+
+func (e *EtcdRegistryDiscory) GetInstances() ([]Instance, error) {
+	if err := e.Refresh(); err != nil {
+		return nil, err
+	}
+	return e.MultiServersDiscovery.GetInstances()
+}
+
+func (e *EtcdRegistryDiscory) GetServiceInstances(service string) ([]Instance, error) {
+	if err := e.Refresh(); err != nil {
+		return nil, err
+	}
+	return e.MultiServersDiscovery.GetServiceInstances(service)
 }
 
 func (e *EtcdRegistryDiscory) GetAll() ([]string, error) {
@@ -112,6 +245,16 @@ func (e *EtcdRegistryDiscory) GetAll() ([]string, error) {
 	return e.MultiServersDiscovery.GetAll()
 }
 
+// 变化由监听协程推送，监听出错期间退回到每 timeout 全量拉取一次
+func (e *EtcdRegistryDiscory) Watch(ctx context.Context) <-chan []Instance {
+	ch := e.MultiServersDiscovery.Watch(ctx)
+	go func() {
+		_ = e.Refresh()
+		pollRefresh(ctx, e.timeout, e.Refresh)
+	}()
+	return ch
+}
+
 func (e *EtcdRegistryDiscory) Close() error {
 	e.cancelWatch()  // 先取消监听
 	e.client.Close() // 然后关闭
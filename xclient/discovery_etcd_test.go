@@ -0,0 +1,118 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:59:30
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:59:30
+ * @FilePath: /TinyRpcByGo/xclient/discovery_etcd_test.go
+ */
+package xclient
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"tinyrpc/config"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// 内存中的 etcd，Get 返回当前的 kvs，每次 Watch 返回一个由测试控制的 channel
+type fakeEtcd struct {
+	mu       sync.Mutex
+	kvs      map[string]string
+	revision int64
+	gets     int
+	watches  []fakeWatch
+	watched  chan struct{}
+}
+
+type fakeWatch struct {
+	ctx context.Context
+	rev int64
+	ch  chan clientv3.WatchResponse
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: make(map[string]string), revision: 1, watched: make(chan struct{}, 8)}
+}
+
+func (f *fakeEtcd) put(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision++
+	f.kvs[key] = value
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets++
+	resp := &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: f.revision}}
+	for k, v := range f.kvs {
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(v)})
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	ch := make(chan clientv3.WatchResponse, 1)
+	f.mu.Lock()
+	f.watches = append(f.watches, fakeWatch{ctx: ctx, rev: op.Rev(), ch: ch})
+	f.mu.Unlock()
+	f.watched <- struct{}{}
+	return ch
+}
+
+func (f *fakeEtcd) Close() error { return nil }
+
+func (f *fakeEtcd) watch(i int) fakeWatch {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.watches[i]
+}
+
+// 监听的 revision 被压缩后重新全量拉取，从新的 revision 继续监听，旧的监听被取消
+func TestEtcdDiscoveryResyncAfterCompaction(t *testing.T) {
+	f := newFakeEtcd()
+	f.put(config.EtcdProviderPath+"/Arith/tcp@10.0.0.1:1", `{"Addr":"tcp@10.0.0.1:1","Service":"Arith"}`)
+	d := newEtcdRegistryDiscory("", f, time.Minute)
+	defer d.Close()
+
+	waitWatch := func() {
+		select {
+		case <-f.watched:
+		case <-time.After(3 * time.Second):
+			t.Fatal("watch not started")
+		}
+	}
+	waitWatch()
+	first := f.watch(0)
+	if first.rev != 3 {
+		t.Errorf("first watch starts at revision %d, want 3", first.rev)
+	}
+
+	// 压缩期间错过了一个新的实例
+	f.put(config.EtcdProviderPath+"/Arith/tcp@10.0.0.2:1", `{"Addr":"tcp@10.0.0.2:1","Service":"Arith"}`)
+	first.ch <- clientv3.WatchResponse{CompactRevision: 3}
+	waitWatch()
+
+	select {
+	case <-first.ctx.Done():
+	default:
+		t.Error("the compacted watch should be canceled")
+	}
+	if second := f.watch(1); second.rev != 4 {
+		t.Errorf("second watch starts at revision %d, want 4", second.rev)
+	}
+	servers, err := d.MultiServersDiscovery.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 {
+		t.Errorf("expect 2 servers after resync, got %v", servers)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:12:19
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:42:57
+ * @FilePath: /TinyRpcByGo/xclient/discovery_file.go
+ */
+package xclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//-------------------------------------------------------------------------------------
+// 基于文件的服务发现，用于没有注册中心的环境，由配置管理工具下发实例列表文件
+// 文件内容是实例列表，扩展名为 .yaml/.yml 时按 YAML 解析，否则按 JSON 解析，字段同 Instance：
+//   - addr: tcp@10.0.0.1:9999
+//     service: Arith
+//     weight: 10
+//     zone: us-east-1a
+//     tags: {canary: "true"}
+// 后台每 interval 检查一次文件，修改时间或大小变化时重新加载
+// 新文件解析成功后整体替换服务列表并通知订阅方，解析失败、文件为空或者没有实例时保留原来的列表
+// 写了一半的 JSON 文件无法解析，但是 YAML 文件在两个实例之间被截断时仍然可以解析，只是少了后面的实例，
+// 因此下发文件时应先写到同一目录下的临时文件再改名，不要直接覆盖写
+
+type FileDiscovery struct {
+	*MultiServersDiscovery
+	path     string
+	interval time.Duration
+	modTime  time.Time // 上一次加载的文件的修改时间和大小
+	size     int64
+	content  []byte // 上一次加载的文件内容，只改了修改时间时不重新解析
+	cancel   func()
+}
+
+const defaultFileInterval = time.Second * 5
+
+// 创建时加载一次文件，文件不存在、格式错误或者没有实例时返回错误
+func NewFileDiscovery(path string, interval time.Duration) (*FileDiscovery, error) {
+	if interval <= 0 {
+		interval = defaultFileInterval
+	}
+	d := &FileDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(nil),
+		path:                  path,
+		interval:              interval,
+	}
+	d.mu.Lock()
+	err := d.reload()
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	go pollRefresh(ctx, interval, d.Refresh)
+	return d, nil
+}
+
+// 文件有变化时重新加载
+func (d *FileDiscovery) Refresh() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	info, err := os.Stat(d.path)
+	if err != nil {
+		d.log().Error("rpc discovery: stat discovery file error", "path", d.path, "err", err)
+		return err
+	}
+	if info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return nil
+	}
+	return d.reload()
+}
+
+// 调用方需持有锁
+func (d *FileDiscovery) reload() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(d.path)
+	if err != nil {
+		d.log().Error("rpc discovery: read discovery file error", "path", d.path, "err", err)
+		return err
+	}
+	d.modTime, d.size = info.ModTime(), info.Size()
+	if d.content != nil && bytes.Equal(content, d.content) {
+		return nil
+	}
+
+	instances, err := parseInstances(d.path, content)
+	if err != nil {
+		d.log().Error("rpc discovery: parse discovery file error, keep the old servers", "path", d.path, "err", err)
+		return err
+	}
+	d.log().Info("rpc discovery: load discovery file", "path", d.path, "servers", len(instances))
+	d.content = content
+	d.setInstances(instances)
+	return nil
+}
+
+func parseInstances(path string, content []byte) ([]Instance, error) {
+	// 覆盖写时文件会先被清空，这时读到的空文件不能当作没有实例
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, fmt.Errorf("rpc discovery: discovery file %s is empty", path)
+	}
+	var instances []Instance
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &instances)
+	default:
+		err = json.Unmarshal(content, &instances)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("rpc discovery: no instances in %s", path)
+	}
+	for i, ins := range instances {
+		if ins.Addr == "" {
+			return nil, fmt.Errorf("rpc discovery: instance %d in %s has no addr", i, path)
+		}
+	}
+	return instances, nil
+}
+
+func (d *FileDiscovery) Close() error {
+	d.cancel()
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 03:02:35
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 03:02:35
+ * @FilePath: /TinyRpcByGo/xclient/discovery_file_test.go
+ */
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 写入文件并把修改时间往后调，保证轮询能发现变化
+func writeDiscoveryFile(t *testing.T, path, content string, age int) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Duration(age) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serversOf(t *testing.T, d *FileDiscovery) string {
+	t.Helper()
+	servers, err := d.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(servers)
+}
+
+func TestFileDiscoveryLoad(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "servers.yaml")
+	writeDiscoveryFile(t, yamlPath, "- addr: tcp@10.0.0.1:1\n  service: Arith\n  weight: 10\n  tags: {canary: \"true\"}\n- addr: 10.0.0.2:1\n  protocol: tcp\n", 0)
+	d, err := NewFileDiscovery(yamlPath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	instances, _ := d.GetInstances()
+	if len(instances) != 2 {
+		t.Fatalf("instances = %+v", instances)
+	}
+	if canary, _ := instances[0].Tag("canary"); instances[0].Weight != 10 || canary != "true" || instances[0].Service != "Arith" {
+		t.Errorf("yaml fields not loaded: %+v", instances[0])
+	}
+	if instances[1].Addr != "tcp@10.0.0.2:1" {
+		t.Errorf("protocol not applied: %+v", instances[1])
+	}
+
+	jsonPath := filepath.Join(dir, "servers.json")
+	writeDiscoveryFile(t, jsonPath, `[{"Addr":"tcp@10.0.0.3:1"}]`, 0)
+	d2, err := NewFileDiscovery(jsonPath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if got := serversOf(t, d2); got != "[tcp@10.0.0.3:1]" {
+		t.Errorf("json servers = %s", got)
+	}
+}
+
+// 空文件、没有实例、没有地址的文件都不能作为初始的服务列表
+func TestFileDiscoveryRejectsBadFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty.yaml":   "",
+		"blank.yaml":   "  \n",
+		"none.json":    "[]",
+		"null.json":    "null",
+		"noaddr.yaml":  "- service: Arith\n",
+		"invalid.json": `[{"Addr":`,
+	} {
+		path := filepath.Join(dir, name)
+		writeDiscoveryFile(t, path, content, 0)
+		if d, err := NewFileDiscovery(path, time.Hour); err == nil {
+			d.Close()
+			t.Errorf("%s: expect error", name)
+		}
+	}
+	if _, err := NewFileDiscovery(filepath.Join(dir, "missing.yaml"), time.Hour); err == nil {
+		t.Error("missing file: expect error")
+	}
+}
+
+// 文件变化后重新加载，新文件有问题时保留上一次的服务列表
+func TestFileDiscoveryReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.yaml")
+	writeDiscoveryFile(t, path, "- addr: tcp@10.0.0.1:1\n", 0)
+	d, err := NewFileDiscovery(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	writeDiscoveryFile(t, path, "- addr: tcp@10.0.0.1:1\n- addr: tcp@10.0.0.2:1\n", 1)
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serversOf(t, d); got != "[tcp@10.0.0.1:1 tcp@10.0.0.2:1]" {
+		t.Fatalf("servers after reload = %s", got)
+	}
+
+	for i, content := range []string{"", "[]", "- addr: [", "- weight: 1\n"} {
+		writeDiscoveryFile(t, path, content, 2+i)
+		if err := d.Refresh(); err == nil {
+			t.Errorf("%q: expect error", content)
+		}
+		if got := serversOf(t, d); got != "[tcp@10.0.0.1:1 tcp@10.0.0.2:1]" {
+			t.Errorf("%q: last good servers replaced by %s", content, got)
+		}
+	}
+
+	// 修复后恢复加载
+	writeDiscoveryFile(t, path, "- addr: tcp@10.0.0.3:1\n", 10)
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serversOf(t, d); got != "[tcp@10.0.0.3:1]" {
+		t.Errorf("servers after fix = %s", got)
+	}
+}
+
+// 订阅方在后台轮询发现文件变化后收到新的列表
+func TestFileDiscoveryWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+	writeDiscoveryFile(t, path, `[{"Addr":"tcp@10.0.0.1:1"}]`, 0)
+	d, err := NewFileDiscovery(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := d.Watch(ctx)
+	if first := <-ch; len(first) != 1 {
+		t.Fatalf("first list = %+v", first)
+	}
+
+	writeDiscoveryFile(t, path, `[{"Addr":"tcp@10.0.0.1:1"},{"Addr":"tcp@10.0.0.2:1"}]`, 1)
+	select {
+	case list := <-ch:
+		if len(list) != 2 {
+			t.Errorf("watched list = %+v", list)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update after the file changed")
+	}
+}
@@ -8,7 +8,9 @@
 package xclient
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -45,9 +47,9 @@ func NewTinyRegistryDiscovery(registerAddr string, timeout time.Duration) *TinyR
 }
 
 func (d *TinyRegistryDiscory) Update(servers []string) error {
+	_ = d.MultiServersDiscovery.Update(servers)
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
 	d.lastUpdate = time.Now()
 	return nil
 }
@@ -60,30 +62,57 @@ func (d *TinyRegistryDiscory) Refresh() error {
 		return nil
 	}
 
-	log.Println("rpc register: refresh servers from registry", d.registry)
+	d.log().Debug("rpc discovery: refresh servers from registry", "registry", d.registry)
 	resp, err := http.Get(d.registry)
 	if err != nil {
-		log.Panicln("rpc registry refresh err:", err)
+		d.log().Error("rpc discovery: refresh from registry error", "registry", d.registry, "err", err)
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	// 注册中心出错时响应中没有服务列表，保留上一次拉取到的列表，下一次调用时重新拉取
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("rpc discovery: refresh from registry: %s", resp.Status)
+		d.log().Error("rpc discovery: refresh from registry error", "registry", d.registry, "err", err)
 		return err
 	}
 
-	servers := strings.Split(resp.Header.Get("X-tinyrpc-Servers"), ",")
-
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
-		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
+	// 注册中心在响应体中以 JSON 返回带元数据的实例列表，旧版本的注册中心只有响应头中的地址列表
+	var instances []Instance
+	if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		instances = instances[:0]
+		for _, server := range strings.Split(resp.Header.Get("X-tinyrpc-Servers"), ",") {
+			if strings.TrimSpace(server) != "" {
+				instances = append(instances, Instance{Addr: strings.TrimSpace(server)})
+			}
 		}
 	}
+
+	d.setInstances(instances)
 	d.lastUpdate = time.Now()
 	return nil
 }
 
-func (d *TinyRegistryDiscory) Get(mode SelectMode) (string, error) {
+func (d *TinyRegistryDiscory) Get(mode SelectMode, state ConnState) (string, error) {
 	if err := d.Refresh(); err != nil {
 		return "", err
 	}
-	return d.MultiServersDiscovery.Get(mode)
+	return d.MultiServersDiscovery.Get(mode, state)
+}
+
+func (d *TinyRegistryDiscory) GetInstances() ([]Instance, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetInstances()
+}
+
+func (d *TinyRegistryDiscory) GetServiceInstances(service string) ([]Instance, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetServiceInstances(service)
 }
 
 func (d *TinyRegistryDiscory) GetAll() ([]string, error) {
@@ -93,3 +122,14 @@ func (d *TinyRegistryDiscory) GetAll() ([]string, error) {
 
 	return d.MultiServersDiscovery.GetAll()
 }
+
+// 订阅期间每 timeout 从注册中心拉取一次，拉取到的列表有变化时通知订阅方
+// 先立即拉取一次，没有拉取过的服务列表订阅时是空的
+func (d *TinyRegistryDiscory) Watch(ctx context.Context) <-chan []Instance {
+	ch := d.MultiServersDiscovery.Watch(ctx)
+	go func() {
+		_ = d.Refresh()
+		pollRefresh(ctx, d.timeout, d.Refresh)
+	}()
+	return ch
+}
@@ -0,0 +1,52 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 03:05:49
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 03:05:49
+ * @FilePath: /TinyRpcByGo/xclient/discovery_rpc_test.go
+ */
+package xclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryDiscoveryKeepsOldOnError(t *testing.T) {
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "registry down", http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]Instance{{Addr: "tcp@10.0.0.1:8001"}, {Addr: "tcp@10.0.0.2:8002"}})
+	}))
+	defer srv.Close()
+
+	d := NewTinyRegistryDiscovery(srv.URL, time.Minute)
+	servers, err := d.GetAll()
+	if err != nil || len(servers) != 2 {
+		t.Fatalf("unexpected servers %v, err %v", servers, err)
+	}
+
+	fail.Store(true)
+	d.mu.Lock()
+	d.lastUpdate = time.Time{}
+	d.mu.Unlock()
+	if err := d.Refresh(); err == nil {
+		t.Error("expect error for registry status 500")
+	}
+	if servers, _ := d.MultiServersDiscovery.GetAll(); len(servers) != 2 {
+		t.Errorf("registry error should keep the old servers, got %v", servers)
+	}
+
+	// 出错后没有更新时间，下一次调用时重新拉取
+	fail.Store(false)
+	if err := d.Refresh(); err != nil {
+		t.Errorf("expect refresh to recover, got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 01:56:27
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:58:25
+ * @FilePath: /TinyRpcByGo/xclient/failmode.go
+ */
+package xclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+	. "tinyrpc"
+)
+
+// 调用失败时的处理方式
+type FailMode int
+
+const (
+	Failfast   FailMode = iota // 直接返回错误，设置了 Option.Retry 时按重试策略换一个实例重试，同 Failover
+	Failover                   // 换一个实例重试，最多重试 retries 次，设置了 Option.Retry 时按重试策略
+	Failtry                    // 在同一个实例上重试，最多重试 retries 次，设置了 Option.Retry 时按重试策略
+	Failbackup                 // 超过 backupDelay 还没有返回时，向另一个实例发送相同的请求，取先成功的结果
+)
+
+const (
+	defaultRetries     = 2
+	defaultBackupDelay = 10 * time.Millisecond
+)
+
+// XClient 的可选项，通过 NewXClient 的可变参数传入
+type XClientOption func(*xclientOptions)
+
+type xclientOptions struct {
+	failMode    FailMode
+	retries     int
+	backupDelay time.Duration
+	idempotent  map[string]bool
+	breaker     *BreakerConfig  // 为空时不熔断
+	outlier     *OutlierConfig  // 为空时不做离群检测
+	hedging     *HedgingPolicy  // 为空时不对冲
+	name        string          // 调试页面上的名字
+	selector    Selector        // 只选择满足条件的实例
+	locality    *LocalityConfig // 为空时不做区域感知
+}
+
+func defaultXClientOptions() xclientOptions {
+	return xclientOptions{
+		failMode:    Failfast,
+		retries:     defaultRetries,
+		backupDelay: defaultBackupDelay,
+		idempotent:  make(map[string]bool),
+	}
+}
+
+// 设置失败模式，默认 Failfast
+func WithFailMode(mode FailMode) XClientOption {
+	return func(o *xclientOptions) {
+		o.failMode = mode
+	}
+}
+
+// 设置 Failover 和 Failtry 的最大重试次数，不包括第一次调用，设置了 Option.Retry 时以 MaxAttempts 为准
+func WithRetries(n int) XClientOption {
+	return func(o *xclientOptions) {
+		if n >= 0 {
+			o.retries = n
+		}
+	}
+}
+
+// 设置 Failbackup 发送备份请求前等待的时间
+func WithBackupDelay(d time.Duration) XClientOption {
+	return func(o *xclientOptions) {
+		if d > 0 {
+			o.backupDelay = d
+		}
+	}
+}
+
+// 声明幂等的方法，格式为 "Service.Method"，"*" 表示所有方法都是幂等的
+// 幂等的方法在任何服务端错误后都可以重试，也可以发送备份请求
+// 其他方法只在确定请求还没有发出时重试（拨号失败、熔断器打开、发送前连接已经断开），不发送备份请求
+func WithIdempotent(serviceMethods ...string) XClientOption {
+	return func(o *xclientOptions) {
+		for _, m := range serviceMethods {
+			o.idempotent[m] = true
+		}
+	}
+}
+
+func (xc *XClient) idempotent(serviceMethod string) bool {
+	return xc.xopt.idempotent["*"] || xc.xopt.idempotent[serviceMethod]
+}
+
+// Failover 和 Failtry 的重试策略，设置了 Option.Retry 时使用它的次数、退避和预算，否则按 WithRetries 立即重试
+func (xc *XClient) retryPolicy(serviceMethod string) *RetryPolicy {
+	if xc.opt != nil && xc.opt.Retry != nil {
+		return xc.opt.Retry.ForMethod(serviceMethod)
+	}
+	return &RetryPolicy{MaxAttempts: xc.xopt.retries + 1}
+}
+
+// 判断失败的调用能否重试
+// 1. 调用方的 ctx 已经结束，不重试
+// 2. 请求还没有发出的错误都可以重试
+// 3. 请求本身有问题（参数错误、方法不存在）时重试也没有用
+// 4. 其他错误只有幂等的方法才重试，服务端可能已经执行过一次
+// 请求发出后连接断开同样是 CodeUnavailable，但服务端可能已经收到并执行了请求，不能当作没有发出
+// 设置了 Option.Retry 时，错误码还需要在 RetryableCodes 中
+func (xc *XClient) retryable(ctx context.Context, serviceMethod string, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if xc.opt != nil && xc.opt.Retry != nil && !xc.opt.Retry.ForMethod(serviceMethod).Retryable(err) {
+		return false
+	}
+	if notSent(err) {
+		return true
+	}
+	switch ErrorCode(err) {
+	case CodeInvalidArgument, CodeNotFound, CodeCanceled:
+		return false
+	}
+	return xc.idempotent(serviceMethod)
+}
+
+// 请求确定还没有发出：拨号失败、熔断器打开，或者 Client 在发送前已经关闭（只有这时返回 ErrShutdown）
+func notSent(err error) bool {
+	var de *dialError
+	return err == ErrCircuitOpen || err == ErrShutdown || errors.As(err, &de)
+}
+
+// 换一个实例重试，已经失败过的实例不再选择，所有实例都失败过时不再过滤
+func (xc *XClient) failover(ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
+	tried := make(map[string]bool)
+	filter := func(addr string) bool { return !tried[addr] }
+	var lastErr error
+	stop := false // 选择实例失败时不再重试，返回上一次调用的错误
+	retryable := func(err error) bool { return !stop && xc.retryable(ctx, serviceMethod, err) }
+	return xc.retryPolicy(serviceMethod).Do(ctx, retryable, func(ctx context.Context, attempt int) error {
+		rpcAddr, err := xc.selectServer(ctx, serviceMethod, args, filter)
+		if err == ErrNoAvailable && len(tried) > 0 {
+			rpcAddr, err = xc.selectServer(ctx, serviceMethod, args, nil)
+		}
+		if err != nil {
+			stop = true
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		err = xc.hedgeCall(rpcAddr, ctx, serviceMethod, args, replyv)
+		if err != nil {
+			tried[rpcAddr] = true
+			lastErr = err
+			xc.log().Debug("rpc xclient: failover", "service_method", serviceMethod, "addr", rpcAddr,
+				"attempt", attempt, "code", ErrorCode(err), "err", err)
+		}
+		return err
+	})
+}
+
+// 在同一个实例上重试
+func (xc *XClient) failtry(ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
+	rpcAddr, err := xc.selectServer(ctx, serviceMethod, args, nil)
+	if err != nil {
+		return err
+	}
+	retryable := func(err error) bool { return xc.retryable(ctx, serviceMethod, err) }
+	return xc.retryPolicy(serviceMethod).Do(ctx, retryable, func(ctx context.Context, attempt int) error {
+		err := xc.call(rpcAddr, ctx, serviceMethod, args, replyv)
+		if err != nil {
+			xc.log().Debug("rpc xclient: failtry", "service_method", serviceMethod, "addr", rpcAddr,
+				"attempt", attempt, "code", ErrorCode(err), "err", err)
+		}
+		return err
+	})
+}
+
+// 先向一个实例发送请求，超过 backupDelay 还没有返回，或者很快返回了可以重试的错误时，
+// 再向另一个实例发送相同的请求，取先成功的结果，另一个请求随之取消
+// 不幂等的方法不发送备份请求，只在请求还没有发出的错误后重试一次
+func (xc *XClient) failbackup(ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
+	first, err := xc.selectServer(ctx, serviceMethod, args, nil)
+	if err != nil {
+		return err
+	}
+	return xc.backup(first, ctx, serviceMethod, args, replyv, xc.xopt.backupDelay, nil, true)
+}
+
+// Failbackup 和对冲请求共用，第一个请求发往 first，budget 不为空时发送第二个请求前需要从中取出令牌
+// retryOnError 为 false 时只在超过 delay 后发送第二个请求，第一个请求很快失败时直接返回错误
+func (xc *XClient) backup(first string, ctx context.Context, serviceMethod string, args interface{}, replyv interface{},
+	delay time.Duration, budget *RetryBudget, retryOnError bool) error {
+	var err error
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan result, 2) // 带缓冲，返回后另一个请求也不会阻塞
+	send := func(rpcAddr string) {
+		// 两个请求同时进行，各自解码到一份拷贝中，成功的那份再赋值给 replyv
+		var clonedReply interface{}
+		if replyv != nil {
+			clonedReply = reflect.New(reflect.ValueOf(replyv).Elem().Type()).Interface()
+		}
+		go func() {
+			ch <- result{reply: clonedReply, err: xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)}
+		}()
+	}
+	done := func(r result) error {
+		if r.err == nil && replyv != nil {
+			reflect.ValueOf(replyv).Elem().Set(reflect.ValueOf(r.reply).Elem())
+		}
+		return r.err
+	}
+
+	send(first)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		if !retryOnError || !xc.retryable(ctx, serviceMethod, r.err) || (budget != nil && !budget.Withdraw()) {
+			return done(r)
+		}
+		err = r.err
+	case <-timer.C:
+		if !xc.idempotent(serviceMethod) || (budget != nil && !budget.Withdraw()) {
+			return done(<-ch)
+		}
+	}
+
+	second, e := xc.selectServer(ctx, serviceMethod, args, func(addr string) bool { return addr != first })
+	if e != nil {
+		// 只有一个实例，没有发送备份请求
+		if err != nil {
+			return err
+		}
+		return done(<-ch)
+	}
+	xc.log().Debug("rpc xclient: send backup request", "service_method", serviceMethod, "addr", second, "first", first)
+	send(second)
+
+	pending := 2
+	if err != nil {
+		pending = 1
+	}
+	for ; pending > 0; pending-- {
+		r := <-ch
+		if r.err == nil {
+			return done(r)
+		}
+		if err == nil {
+			err = r.err
+		}
+	}
+	return err
+}
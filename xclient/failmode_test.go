@@ -0,0 +1,96 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:58:25
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:58:25
+ * @FilePath: /TinyRpcByGo/xclient/failmode_test.go
+ */
+package xclient
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	. "tinyrpc"
+	"tinyrpc/codec"
+)
+
+// 收到请求后不响应、直接断开连接的服务端，返回地址和收到的请求数
+func startDroppingServer(t *testing.T) (string, *int64) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	var received int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var opt Option
+				if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+					return
+				}
+				if err := json.NewEncoder(conn).Encode(opt); err != nil {
+					return
+				}
+				cc := codec.NewCodecFuncMap[opt.CodecType](conn)
+				var h codec.Header
+				if err := cc.ReadHeader(&h); err != nil {
+					return
+				}
+				_ = cc.ReadBody(nil)
+				atomic.AddInt64(&received, 1)
+			}()
+		}
+	}()
+	return "tcp@" + l.Addr().String(), &received
+}
+
+// 请求发出后连接断开时，服务端可能已经执行过，不幂等的方法不能换实例重试
+func TestFailoverDoesNotRetryNonIdempotentAfterSend(t *testing.T) {
+	a, na := startDroppingServer(t)
+	b, nb := startDroppingServer(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{a, b}), RoundRobinSelect, nil, WithFailMode(Failover))
+	defer xc.Close()
+
+	var reply int
+	if err := xc.Call(context.Background(), "Arith.Sum", Args{A: 1, B: 2}, &reply); ErrorCode(err) != CodeUnavailable {
+		t.Fatalf("expect unavailable, got %v", err)
+	}
+	if n := atomic.LoadInt64(na) + atomic.LoadInt64(nb); n != 1 {
+		t.Errorf("non-idempotent call sent %d times", n)
+	}
+
+	xc2 := NewXClient(NewMultiServerDiscovery([]string{a, b}), RoundRobinSelect, nil,
+		WithFailMode(Failover), WithIdempotent("Arith.Sum"))
+	defer xc2.Close()
+	atomic.StoreInt64(na, 0)
+	atomic.StoreInt64(nb, 0)
+	if err := xc2.Call(context.Background(), "Arith.Sum", Args{A: 1, B: 2}, &reply); err == nil {
+		t.Fatal("expect error")
+	}
+	if n := atomic.LoadInt64(na) + atomic.LoadInt64(nb); n != int64(defaultRetries+1) {
+		t.Errorf("idempotent call sent %d times, want %d", n, defaultRetries+1)
+	}
+}
+
+// 拨号失败时请求还没有发出，不幂等的方法也换一个实例重试
+func TestFailoverRetriesNonIdempotentOnDialError(t *testing.T) {
+	live := startServer(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{deadAddr, live}), RoundRobinSelect, nil, WithFailMode(Failover))
+	defer xc.Close()
+	for i := 0; i < 10; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Arith.Sum", Args{A: i, B: 1}, &reply); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+}
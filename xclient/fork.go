@@ -0,0 +1,88 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:02:37
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:24:00
+ * @FilePath: /TinyRpcByGo/xclient/fork.go
+ */
+package xclient
+
+import (
+	"context"
+	"reflect"
+)
+
+// 并行发送给所有服务端，返回第一个成功的结果，其余请求随即取消，取消会通知到服务端
+// 用额外的服务端资源换取更低的尾延迟，只适合幂等的读请求
+func (xc *XClient) Fork(ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
+	return xc.ForkN(ctx, 0, serviceMethod, args, replyv)
+}
+
+// 同 Fork，但只发送给 n 个服务端，n 不大于 0 或者超过服务端数量时发送给所有服务端
+// 与 Call 一样跳过熔断器打开的、被离群检测摘除的和其他区域的实例
+// 发送给部分服务端时由负载均衡策略选出 n 个不同的实例
+func (xc *XClient) ForkN(ctx context.Context, n int, serviceMethod string, args interface{}, replyv interface{}) error {
+	provided, _, allow, err := xc.route(ctx, serviceMethod, args, nil)
+	if err != nil {
+		return err
+	}
+	var servers []string
+	for _, ins := range provided {
+		if allow == nil || allow(ins.Addr) {
+			servers = append(servers, ins.Addr)
+		}
+	}
+	if len(servers) == 0 {
+		if xc.xopt.breaker != nil {
+			return ErrCircuitOpen
+		}
+		return ErrNoAvailable
+	}
+	if n > 0 && n < len(servers) {
+		picked := make(map[string]bool, n)
+		filter := func(addr string) bool { return !picked[addr] }
+		servers = servers[:0:0]
+		for len(servers) < n {
+			rpcAddr, err := xc.selectServer(ctx, serviceMethod, args, filter)
+			if err != nil {
+				break
+			}
+			picked[rpcAddr] = true
+			servers = append(servers, rpcAddr)
+		}
+		if len(servers) == 0 {
+			return ErrNoAvailable
+		}
+	}
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 返回后取消其余的请求
+	ch := make(chan result, len(servers))
+	for _, rpcAddr := range servers {
+		var clonedReply interface{}
+		if replyv != nil {
+			clonedReply = reflect.New(reflect.ValueOf(replyv).Elem().Type()).Interface()
+		}
+		go func(rpcAddr string, reply interface{}) {
+			ch <- result{reply: reply, err: xc.call(rpcAddr, ctx, serviceMethod, args, reply)}
+		}(rpcAddr, clonedReply)
+	}
+
+	for i := 0; i < len(servers); i++ {
+		r := <-ch
+		if r.err == nil {
+			if replyv != nil {
+				reflect.ValueOf(replyv).Elem().Set(reflect.ValueOf(r.reply).Elem())
+			}
+			return nil
+		}
+		if err == nil {
+			err = r.err
+		}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 01:52:00
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 01:56:27
+ * @FilePath: /TinyRpcByGo/xclient/hash.go
+ */
+package xclient
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// 一致性哈希使用的虚拟节点数，虚拟节点越多，服务端之间的负载越均匀
+const defaultReplicas = 160
+
+// 一致性哈希环
+// 每个服务实例在环上放置 replicas 个虚拟节点，key 顺时针找到的第一个虚拟节点即为选中的实例
+// 服务列表变化时，只有落在变化节点上的 key 会迁移，其他 key 仍然路由到原来的实例
+type hashRing struct {
+	replicas int
+	keys     []uint32 // 排好序的虚拟节点
+	nodes    map[uint32]string
+}
+
+func newHashRing(replicas int, servers []string) *hashRing {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	r := &hashRing{
+		replicas: replicas,
+		nodes:    make(map[uint32]string, replicas*len(servers)),
+	}
+	for _, s := range servers {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + s))
+			r.keys = append(r.keys, h)
+			r.nodes[h] = s
+		}
+	}
+	sort.Slice(r.keys, func(i, j int) bool { return r.keys[i] < r.keys[j] })
+	return r
+}
+
+// allow 为空时不过滤，否则顺时针跳过不允许的实例，都不允许时返回空字符串
+func (r *hashRing) get(key string, allow func(string) bool) string {
+	if len(r.keys) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= h })
+	for i := 0; i < len(r.keys); i++ {
+		node := r.nodes[r.keys[(idx+i)%len(r.keys)]]
+		if allow == nil || allow(node) {
+			return node
+		}
+	}
+	return ""
+}
+
+//-------------------------------------------------------------------------------------
+// 路由键，ConsistentHashSelect 模式下相同路由键的请求会落到同一个服务实例上
+// 获取顺序：
+// 1. context 中通过 WithHashKey 设置的路由键
+// 2. XClient.SetHashKeyFunc 设置的钩子函数，返回空字符串时继续向下查找
+// 3. 参数实现了 HashKeyer 接口
+
+var ErrNoHashKey = errors.New("rpc xclient: consistent hash select needs a routing key")
+
+type hashKeyCtxKey struct{}
+
+// 为本次调用设置一致性哈希的路由键，比如用户 ID
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtxKey{}, key)
+}
+
+func HashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKeyCtxKey{}).(string)
+	return key, ok
+}
+
+// 参数可以实现这个接口，直接给出自己的路由键
+type HashKeyer interface {
+	HashKey() string
+}
+
+// 从调用参数中提取路由键的钩子函数，返回空字符串表示没有路由键
+type HashKeyFunc func(serviceMethod string, args interface{}) string
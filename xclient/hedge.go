@@ -0,0 +1,162 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:03:35
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:55:57
+ * @FilePath: /TinyRpcByGo/xclient/hedge.go
+ */
+package xclient
+
+import (
+	"context"
+	"sync"
+	"time"
+	. "tinyrpc"
+	"tinyrpc/stats"
+)
+
+// 对冲请求
+// 调用超过该方法最近延迟的 Percentile 分位数还没有返回时，向另一个实例发送一个相同的请求，取先返回的结果
+// 触发的时间来自每个方法的延迟直方图，跟随服务端的实际延迟变化，不需要手动调整固定的等待时间
+// 只对幂等的方法（见 WithIdempotent）发送对冲请求，额外的请求受令牌预算限制
+
+type HedgingPolicy struct {
+	Percentile float64       // 触发对冲的延迟分位数，默认 0.95
+	MinSamples int           // 直方图中的样本少于它时不对冲，默认 20
+	MinDelay   time.Duration // 触发时间的下限，避免延迟很低时几乎每个请求都对冲，默认 1ms
+	Window     time.Duration // 直方图的统计窗口，每个窗口重新统计，默认 1 分钟
+	Budget     *RetryBudget  // 对冲请求的预算，为空时最多对冲 10% 的请求
+}
+
+const (
+	defaultHedgePercentile = 0.95
+	defaultHedgeMinSamples = 20
+	defaultHedgeMinDelay   = time.Millisecond
+	defaultHedgeWindow     = time.Minute
+	defaultHedgeRatio      = 0.1
+	defaultHedgeBurst      = 10
+)
+
+// 开启对冲请求，零值字段使用默认值
+// Failfast 和 Failbackup 模式下生效，Failbackup 的固定等待时间被自适应的触发时间代替
+// 只对通过 WithIdempotent 声明为幂等的方法生效，没有声明任何幂等的方法时对冲不会发生，创建 XClient 时会打印警告
+func WithHedging(policy HedgingPolicy) XClientOption {
+	return func(o *xclientOptions) {
+		if policy.Percentile <= 0 || policy.Percentile >= 1 {
+			policy.Percentile = defaultHedgePercentile
+		}
+		if policy.MinSamples <= 0 {
+			policy.MinSamples = defaultHedgeMinSamples
+		}
+		if policy.MinDelay <= 0 {
+			policy.MinDelay = defaultHedgeMinDelay
+		}
+		if policy.Window <= 0 {
+			policy.Window = defaultHedgeWindow
+		}
+		if policy.Budget == nil {
+			policy.Budget = NewRetryBudget(defaultHedgeRatio, defaultHedgeBurst)
+		}
+		o.hedging = &policy
+	}
+}
+
+// 一个方法的延迟统计，当前窗口写入，上一个窗口的样本足够时从上一个窗口读取，避免窗口刚切换时没有数据
+type methodLatency struct {
+	mu      sync.Mutex
+	cur     *stats.Histogram
+	prev    *stats.Histogram
+	rotated time.Time
+}
+
+func (m *methodLatency) rotate(now time.Time, window time.Duration) {
+	if now.Sub(m.rotated) >= window {
+		m.prev, m.cur = m.cur, stats.NewHistogram()
+		m.rotated = now
+	}
+}
+
+func (xc *XClient) methodLatency(serviceMethod string) *methodLatency {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	m, ok := xc.latencies[serviceMethod]
+	if !ok {
+		m = &methodLatency{cur: stats.NewHistogram(), rotated: time.Now()}
+		xc.latencies[serviceMethod] = m
+	}
+	return m
+}
+
+// 记录成功调用的延迟，失败的调用可能很快返回，不计入
+func (xc *XClient) observeMethod(serviceMethod string, latency time.Duration, err error) {
+	policy := xc.xopt.hedging
+	if policy == nil || err != nil {
+		return
+	}
+	m := xc.methodLatency(serviceMethod)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate(time.Now(), policy.Window)
+	m.cur.Observe(latency)
+}
+
+// 触发对冲的时间，样本不足时返回 false
+func (xc *XClient) hedgeDelay(serviceMethod string) (time.Duration, bool) {
+	policy := xc.xopt.hedging
+	m := xc.methodLatency(serviceMethod)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate(time.Now(), policy.Window)
+	h := m.cur
+	if m.prev != nil && m.prev.Count() >= uint64(policy.MinSamples) {
+		h = m.prev
+	}
+	if h.Count() < uint64(policy.MinSamples) {
+		return 0, false
+	}
+	delay := h.Quantile(policy.Percentile)
+	if delay < policy.MinDelay {
+		delay = policy.MinDelay
+	}
+	return delay, true
+}
+
+// 带对冲的调用，不能对冲时退化为普通调用
+// Failfast 设置了 Option.Retry 时按 Failover 处理，不经过这里，由 failover 的每一次尝试调用 hedgeCall
+func (xc *XClient) hedge(ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
+	if xc.xopt.failMode != Failbackup {
+		rpcAddr, err := xc.selectServer(ctx, serviceMethod, args, nil)
+		if err != nil {
+			return err
+		}
+		return xc.hedgeCall(rpcAddr, ctx, serviceMethod, args, replyv)
+	}
+
+	policy := xc.xopt.hedging
+	delay, ok := xc.hedgeDelay(serviceMethod)
+	if !ok || !xc.idempotent(serviceMethod) {
+		return xc.failbackup(ctx, serviceMethod, args, replyv)
+	}
+	first, err := xc.selectServer(ctx, serviceMethod, args, nil)
+	if err != nil {
+		return err
+	}
+	policy.Budget.Deposit()
+	return xc.backup(first, ctx, serviceMethod, args, replyv, delay, policy.Budget, true)
+}
+
+// Failfast 时向 rpcAddr 发送请求，可以对冲时超过触发时间还没有返回再向另一个实例发送相同的请求
+// 只在超过触发时间后对冲，第一个请求很快失败时直接返回错误，是否换实例重试由调用方决定
+// 其他失败模式和不能对冲的方法直接调用
+func (xc *XClient) hedgeCall(rpcAddr string, ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
+	policy := xc.xopt.hedging
+	if policy == nil || xc.xopt.failMode != Failfast || !xc.idempotent(serviceMethod) {
+		return xc.call(rpcAddr, ctx, serviceMethod, args, replyv)
+	}
+	delay, ok := xc.hedgeDelay(serviceMethod)
+	if !ok {
+		return xc.call(rpcAddr, ctx, serviceMethod, args, replyv)
+	}
+	policy.Budget.Deposit()
+	return xc.backup(rpcAddr, ctx, serviceMethod, args, replyv, delay, policy.Budget, false)
+}
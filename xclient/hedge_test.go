@@ -0,0 +1,62 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:55:57
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:55:57
+ * @FilePath: /TinyRpcByGo/xclient/hedge_test.go
+ */
+package xclient
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	. "tinyrpc"
+)
+
+// 开启对冲后 Option.Retry 仍然生效，失败的实例换一个重试
+func TestHedgingWithRetrySkipsDeadReplica(t *testing.T) {
+	live := startServer(t)
+	opt := *DefaultOption
+	opt.Retry = &RetryPolicy{MaxAttempts: 5}
+	xc := NewXClient(NewMultiServerDiscovery([]string{deadAddr, live}), RoundRobinSelect, &opt,
+		WithHedging(HedgingPolicy{MinSamples: 1}), WithIdempotent("*"))
+	defer xc.Close()
+
+	for i := 0; i < 20; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Arith.Sum", Args{A: i, B: 1}, &reply); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if reply != i+1 {
+			t.Fatalf("call %d: reply = %d", i, reply)
+		}
+	}
+}
+
+// 没有声明幂等的方法时对冲不会发生，创建时打印警告
+func TestHedgingWithoutIdempotentWarns(t *testing.T) {
+	var buf bytes.Buffer
+	opt := *DefaultOption
+	opt.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	const warning = "hedging only applies to idempotent methods"
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{startServer(t)}), RoundRobinSelect, &opt, WithHedging(HedgingPolicy{}))
+	var reply int
+	if err := xc.Call(context.Background(), "Arith.Sum", Args{A: 1, B: 2}, &reply); err != nil || reply != 3 {
+		t.Errorf("call with default options: reply = %d, err = %v", reply, err)
+	}
+	_ = xc.Close()
+	if !strings.Contains(buf.String(), warning) {
+		t.Errorf("expect warning, got log %q", buf.String())
+	}
+
+	buf.Reset()
+	xc = NewXClient(NewMultiServerDiscovery(nil), RoundRobinSelect, &opt, WithHedging(HedgingPolicy{}), WithIdempotent("Arith.Sum"))
+	_ = xc.Close()
+	if strings.Contains(buf.String(), warning) {
+		t.Errorf("unexpected warning with idempotent methods: %q", buf.String())
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:08:43
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:08:43
+ * @FilePath: /TinyRpcByGo/xclient/locality.go
+ */
+package xclient
+
+import (
+	"math/rand"
+)
+
+// 区域感知路由
+// 跨可用区的流量又贵又慢，开启后只选择与调用方在同一个可用区（Instance.Zone）的实例
+// 本区域的健康实例（熔断器没有打开、没有被离群检测摘除、没有被本次调用排除）不够时才溢出到其他区域：
+// 1. 本区域没有实例，或者健康实例少于 MinHosts 时，全部发往其他区域
+// 2. 健康实例的比例低于 MinHealthyRatio 时，按 1 - 比例/MinHealthyRatio 的概率发往其他区域，本区域恢复时流量逐渐回来
+// 3. 其他情况只发往本区域
+// 需要严格限制在某个区域时使用 WithSelector("zone=...")
+
+type LocalityConfig struct {
+	Zone            string  // 调用方所在的可用区，为空时不做区域感知
+	MinHealthyRatio float64 // 本区域健康实例的比例低于它时开始溢出，默认 0.7
+	MinHosts        int     // 本区域健康实例少于它时全部溢出，默认 1
+}
+
+const (
+	defaultLocalityRatio = 0.7
+	defaultLocalityHosts = 1
+)
+
+// 开启区域感知路由，零值字段使用默认值
+func WithLocality(cfg LocalityConfig) XClientOption {
+	return func(o *xclientOptions) {
+		if cfg.Zone == "" {
+			o.locality = nil
+			return
+		}
+		if cfg.MinHealthyRatio <= 0 || cfg.MinHealthyRatio > 1 {
+			cfg.MinHealthyRatio = defaultLocalityRatio
+		}
+		if cfg.MinHosts <= 0 {
+			cfg.MinHosts = defaultLocalityHosts
+		}
+		o.locality = &cfg
+	}
+}
+
+// 在 allow 的基础上按区域过滤，instances 为可以提供服务的所有实例
+// 返回的 filter 只选择本区域或者只选择其他区域的实例
+func (xc *XClient) localityFilter(serviceMethod string, instances []Instance, allow func(string) bool) func(string) bool {
+	cfg := xc.xopt.locality
+	local := make(map[string]bool)
+	total, healthy, remote := 0, 0, 0
+	for _, ins := range instances {
+		ok := allow == nil || allow(ins.Addr)
+		if ins.Zone == cfg.Zone {
+			local[ins.Addr] = true
+			total++
+			if ok {
+				healthy++
+			}
+		} else if ok {
+			remote++
+		}
+	}
+	if total == 0 || remote == 0 {
+		return allow
+	}
+
+	spill := healthy < cfg.MinHosts
+	if !spill {
+		ratio := float64(healthy) / float64(total)
+		spill = ratio < cfg.MinHealthyRatio && rand.Float64() >= ratio/cfg.MinHealthyRatio
+	}
+	if spill {
+		xc.log().Debug("rpc xclient: spill over to other zones", "service_method", serviceMethod,
+			"zone", cfg.Zone, "healthy", healthy, "total", total)
+	}
+	return func(addr string) bool {
+		return local[addr] != spill && (allow == nil || allow(addr))
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:00:59
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:57:24
+ * @FilePath: /TinyRpcByGo/xclient/outlier.go
+ */
+package xclient
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+	. "tinyrpc"
+)
+
+// 离群检测
+// 熔断器只能发现彻底不可用的实例，变慢或者错误率偏高、但还能响应心跳的实例需要横向比较才能发现
+// 每个检测周期统计所有实例的错误率和平均延迟，比均值高出 StdevFactor 个标准差的实例被临时摘除
+// 同一个实例第 n 次被摘除的时长为 n * BaseEjection，不超过 MaxEjection，没有被摘除的周期会让 n 减一
+// 同时被摘除的实例不超过 MaxEjectionPercent，避免所有实例一起变慢时把流量集中到少数实例上
+
+type OutlierConfig struct {
+	Interval           time.Duration // 检测周期，默认 10s
+	BaseEjection       time.Duration // 第一次摘除的时长，默认 30s
+	MaxEjection        time.Duration // 摘除时长的上限，默认 5m
+	MaxEjectionPercent int           // 同时被摘除的实例占比的上限，默认 50
+	MinRequests        int           // 一个周期内请求数少于它的实例不参与统计，默认 10
+	MinHosts           int           // 参与统计的实例少于它时不检测，默认 3
+	StdevFactor        float64       // 高出均值多少个标准差算离群，默认 1
+}
+
+const (
+	defaultOutlierInterval = 10 * time.Second
+	defaultOutlierEjection = 30 * time.Second
+	defaultOutlierMaxEject = 5 * time.Minute
+	defaultOutlierPercent  = 50
+	defaultOutlierRequests = 10
+	defaultOutlierHosts    = 3
+	defaultOutlierStdev    = 1
+	outlierLatencyRatio    = 1.5 // 延迟离群还需要比均值高出这个倍数，避免延迟都很接近时因为抖动被摘除
+)
+
+// 开启离群检测，零值字段使用默认值
+func WithOutlierDetection(cfg OutlierConfig) XClientOption {
+	return func(o *xclientOptions) {
+		if cfg.Interval <= 0 {
+			cfg.Interval = defaultOutlierInterval
+		}
+		if cfg.BaseEjection <= 0 {
+			cfg.BaseEjection = defaultOutlierEjection
+		}
+		if cfg.MaxEjection <= 0 {
+			cfg.MaxEjection = defaultOutlierMaxEject
+		}
+		if cfg.MaxEjectionPercent <= 0 {
+			cfg.MaxEjectionPercent = defaultOutlierPercent
+		}
+		if cfg.MinRequests <= 0 {
+			cfg.MinRequests = defaultOutlierRequests
+		}
+		if cfg.MinHosts <= 0 {
+			cfg.MinHosts = defaultOutlierHosts
+		}
+		if cfg.StdevFactor <= 0 {
+			cfg.StdevFactor = defaultOutlierStdev
+		}
+		o.outlier = &cfg
+	}
+}
+
+type outlier struct {
+	requests     int // 当前周期内的请求数
+	failures     int
+	latency      time.Duration // 当前周期内的延迟之和
+	ejections    int           // 连续被摘除的次数，决定下一次摘除的时长
+	ejectedUntil time.Time
+	reason       string
+}
+
+// 离群检测的状态，用于调试页面
+type OutlierStatus struct {
+	Addr         string     `json:"addr"`
+	Requests     int        `json:"requests"`
+	Failures     int        `json:"failures"`
+	MeanLatency  string     `json:"mean_latency,omitempty"`
+	Ejections    int        `json:"ejections"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"` // 没有被摘除时为空
+	Reason       string     `json:"reason,omitempty"`
+}
+
+// 调用方取消、参数错误、方法不存在都是调用方的问题，不算实例的失败
+func outlierFailure(err error) bool {
+	switch ErrorCode(err) {
+	case CodeOK, CodeCanceled, CodeInvalidArgument, CodeNotFound:
+		return false
+	}
+	return true
+}
+
+// 调用结束后记录结果
+// 调用方的 ctx 超时或者取消时，请求的失败和延迟说明不了实例的状态，与熔断器一样不记录
+func (xc *XClient) outlierRecord(ctx context.Context, rpcAddr string, latency time.Duration, err error) {
+	if xc.xopt.outlier == nil || err == ErrCircuitOpen || ErrorCode(err) == CodeCanceled {
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	o, ok := xc.outliers[rpcAddr]
+	if !ok {
+		o = &outlier{}
+		xc.outliers[rpcAddr] = o
+	}
+	o.requests++
+	o.latency += latency
+	if outlierFailure(err) {
+		o.failures++
+	}
+}
+
+// 实例是否被摘除，调用方需持有 xc.mu
+func (xc *XClient) ejected(rpcAddr string, now time.Time) bool {
+	o, ok := xc.outliers[rpcAddr]
+	return ok && now.Before(o.ejectedUntil)
+}
+
+// 距离上一次检测超过一个周期时检测一次，调用方需持有 xc.mu
+// 检测在选择实例时顺带完成，不需要单独的 goroutine
+func (xc *XClient) detectOutliers(now time.Time, hosts int) {
+	cfg := xc.xopt.outlier
+	if cfg == nil {
+		return
+	}
+	if xc.lastDetect.IsZero() {
+		xc.lastDetect = now
+		return
+	}
+	if now.Sub(xc.lastDetect) < cfg.Interval {
+		return
+	}
+	xc.lastDetect = now
+
+	type sample struct {
+		addr    string
+		o       *outlier
+		errRate float64
+		latency float64
+	}
+	var samples []sample
+	ejectedNow := 0
+	for addr, o := range xc.outliers {
+		if now.Before(o.ejectedUntil) {
+			ejectedNow++
+			continue
+		}
+		if o.requests >= cfg.MinRequests {
+			samples = append(samples, sample{
+				addr:    addr,
+				o:       o,
+				errRate: float64(o.failures) / float64(o.requests),
+				latency: float64(o.latency) / float64(o.requests),
+			})
+		}
+	}
+	// 按地址排序，保证摘除名额有限时结果是确定的
+	sort.Slice(samples, func(i, j int) bool { return samples[i].addr < samples[j].addr })
+
+	ejected := make(map[string]bool)
+	if len(samples) >= cfg.MinHosts {
+		errRates := make([]float64, len(samples))
+		latencies := make([]float64, len(samples))
+		for i, s := range samples {
+			errRates[i], latencies[i] = s.errRate, s.latency
+		}
+		errMean, errStd := meanStdev(errRates)
+		latMean, latStd := meanStdev(latencies)
+		maxEjected := (hosts * cfg.MaxEjectionPercent) / 100
+
+		for _, s := range samples {
+			if ejectedNow >= maxEjected {
+				break
+			}
+			reason := ""
+			switch {
+			case errStd > 0 && s.errRate > errMean+cfg.StdevFactor*errStd:
+				reason = "error_rate"
+			case latStd > 0 && s.latency > latMean+cfg.StdevFactor*latStd && s.latency > latMean*outlierLatencyRatio:
+				reason = "latency"
+			}
+			if reason == "" {
+				continue
+			}
+			o := s.o
+			o.ejections++
+			d := time.Duration(o.ejections) * cfg.BaseEjection
+			if d > cfg.MaxEjection {
+				d = cfg.MaxEjection
+			}
+			o.ejectedUntil = now.Add(d)
+			o.reason = reason
+			ejected[s.addr] = true
+			ejectedNow++
+			xc.log().Warn("rpc xclient: eject outlier", "addr", s.addr, "reason", reason, "error_rate", s.errRate,
+				"mean_error_rate", errMean, "latency", time.Duration(s.latency), "mean_latency", time.Duration(latMean),
+				"duration", d)
+		}
+	}
+
+	// 开始新的周期，一个周期都没有被摘除的实例，连续摘除次数减一
+	for addr, o := range xc.outliers {
+		if !ejected[addr] && !now.Before(o.ejectedUntil) && o.ejections > 0 {
+			o.ejections--
+		}
+		o.requests, o.failures, o.latency = 0, 0, 0
+	}
+}
+
+func meanStdev(xs []float64) (mean, stdev float64) {
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	for _, x := range xs {
+		stdev += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(stdev / float64(len(xs)))
+}
+
+// 返回所有地址的离群检测状态，按地址排序
+func (xc *XClient) Outliers() []OutlierStatus {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	now := time.Now()
+	status := make([]OutlierStatus, 0, len(xc.outliers))
+	for addr, o := range xc.outliers {
+		s := OutlierStatus{Addr: addr, Requests: o.requests, Failures: o.failures, Ejections: o.ejections}
+		if o.requests > 0 {
+			s.MeanLatency = (o.latency / time.Duration(o.requests)).String()
+		}
+		if now.Before(o.ejectedUntil) {
+			t := o.ejectedUntil
+			s.EjectedUntil = &t
+			s.Reason = o.reason
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Addr < status[j].Addr })
+	return status
+}
@@ -0,0 +1,53 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:57:24
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:57:24
+ * @FilePath: /TinyRpcByGo/xclient/outlier_test.go
+ */
+package xclient
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 调用方的 ctx 很短导致的超时不算实例的失败，不会摘除健康的实例
+func TestOutlierIgnoresCallerTimeout(t *testing.T) {
+	addrs := []string{startServer(t), startServer(t), startServer(t)}
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RoundRobinSelect, nil,
+		WithOutlierDetection(OutlierConfig{Interval: 50 * time.Millisecond, MinRequests: 5}))
+	defer xc.Close()
+
+	var reply int
+	// 第一次选择实例时开始第一个检测周期
+	if err := xc.Call(context.Background(), "Arith.Sum", Args{A: 1, B: 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		for i := 0; i < 5; i++ {
+			if err := xc.call(addr, context.Background(), "Arith.Sum", Args{A: 1, B: 2}, &reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := xc.call(addrs[0], ctx, "Arith.Sleep", Args{A: 100}, &reply)
+		cancel()
+		if err == nil {
+			t.Fatal("expect caller timeout")
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := xc.Call(context.Background(), "Arith.Sum", Args{A: 1, B: 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range xc.Outliers() {
+		if s.EjectedUntil != nil {
+			t.Errorf("%s ejected for caller timeouts: %+v", s.Addr, s)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:07:55
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:07:55
+ * @FilePath: /TinyRpcByGo/xclient/selector.go
+ */
+package xclient
+
+import (
+	"context"
+	"strings"
+)
+
+//-------------------------------------------------------------------------------------
+// 按实例的元数据选择实例，在负载均衡之前过滤，用于金丝雀发布、蓝绿发布等
+// 选择条件的格式，多个条件用逗号分隔，需要同时满足：
+// 1. key=value  元数据 key 等于 value，如 version=v2、zone=us-east-1a
+// 2. key!=value 元数据 key 不等于 value，没有这个元数据也算不等于
+// 3. key        有元数据 key
+// key 为 version、zone、protocol、service 时对应 Instance 中同名的字段，其他的从 Tags 中取，见 Instance.Tag
+
+type selectorTerm struct {
+	key   string
+	value string
+	op    string // "=", "!=" 或 "" 表示只要求有这个元数据
+}
+
+func (t selectorTerm) match(ins Instance) bool {
+	v, ok := ins.Tag(t.key)
+	switch t.op {
+	case "=":
+		return ok && v == t.value
+	case "!=":
+		return !ok || v != t.value
+	}
+	return ok
+}
+
+// 实例的选择条件，零值选择所有实例
+type Selector struct {
+	terms []selectorTerm
+}
+
+// 解析选择条件，空的条件会被忽略
+func ParseSelector(s string) Selector {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var t selectorTerm
+		if k, v, ok := strings.Cut(term, "!="); ok {
+			t = selectorTerm{key: k, value: v, op: "!="}
+		} else if k, v, ok := strings.Cut(term, "="); ok {
+			t = selectorTerm{key: k, value: v, op: "="}
+		} else {
+			t = selectorTerm{key: term}
+		}
+		t.key, t.value = strings.TrimSpace(t.key), strings.TrimSpace(t.value)
+		if t.key != "" {
+			sel.terms = append(sel.terms, t)
+		}
+	}
+	return sel
+}
+
+func (sel Selector) Empty() bool {
+	return len(sel.terms) == 0
+}
+
+func (sel Selector) Match(ins Instance) bool {
+	for _, t := range sel.terms {
+		if !t.match(ins) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	terms := make([]string, 0, len(sel.terms))
+	for _, t := range sel.terms {
+		terms = append(terms, t.key+t.op+t.value)
+	}
+	return strings.Join(terms, ",")
+}
+
+// 两个条件同时满足
+func (sel Selector) and(other Selector) Selector {
+	terms := make([]selectorTerm, 0, len(sel.terms)+len(other.terms))
+	terms = append(terms, sel.terms...)
+	return Selector{terms: append(terms, other.terms...)}
+}
+
+// 只选择满足条件的实例，多次设置时需要同时满足
+func WithSelector(selector string) XClientOption {
+	return func(o *xclientOptions) {
+		o.selector = o.selector.and(ParseSelector(selector))
+	}
+}
+
+type selectorCtxKey struct{}
+
+// 为本次调用设置选择条件，与 WithSelector 设置的条件需要同时满足，比如只把内部用户的请求发给 version=v2
+func WithCallSelector(ctx context.Context, selector string) context.Context {
+	return context.WithValue(ctx, selectorCtxKey{}, ParseSelector(selector))
+}
+
+func SelectorFromContext(ctx context.Context) (Selector, bool) {
+	sel, ok := ctx.Value(selectorCtxKey{}).(Selector)
+	return sel, ok
+}
+
+// 提供 serviceMethod 中的服务并满足选择条件的实例，没有满足条件的实例时返回空列表
+func (xc *XClient) providers(ctx context.Context, serviceMethod string) ([]Instance, error) {
+	instances, err := xc.d.GetServiceInstances(serviceName(serviceMethod))
+	if err != nil {
+		return nil, err
+	}
+	sel := xc.xopt.selector
+	if s, ok := SelectorFromContext(ctx); ok {
+		sel = sel.and(s)
+	}
+	if sel.Empty() {
+		return instances, nil
+	}
+	selected := instances[:0]
+	for _, ins := range instances {
+		if sel.Match(ins) {
+			selected = append(selected, ins)
+		}
+	}
+	return selected, nil
+}
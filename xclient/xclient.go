@@ -9,27 +9,108 @@ package xclient
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"log/slog"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 	. "tinyrpc"
 )
 
 type XClient struct {
-	d       Discoery
-	mode    SelectMode
-	opt     *Option
-	mu      sync.Mutex
-	clients map[string]*Client
+	d          Discoery
+	balancer   Balancer
+	opt        *Option
+	mu         sync.Mutex
+	clients    map[string]*Client
+	hashKey    HashKeyFunc
+	stats      map[string]*addrStat // 每个地址的延迟统计，提供给负载均衡策略
+	updateMu   sync.Mutex
+	instances  []Instance // 上一次交给 balancer 的服务实例，用于判断服务列表是否变化
+	updated    bool
+	watching   bool // 订阅已经收到服务列表，之后只由订阅更新 balancer
+	xopt       xclientOptions
+	breakers   map[string]*breaker
+	outliers   map[string]*outlier
+	latencies  map[string]*methodLatency // 每个方法的延迟直方图，用于对冲请求
+	lastDetect time.Time                 // 上一次离群检测的时间
+	debugName  string                    // 在调试页面上注册的名字，为空时没有注册
+	watchCtx   context.Context           // 订阅服务发现的变化，Close 时取消
+	stopWatch  func()
 }
 
 var _ io.Closer = (*XClient)(nil)
 
-func NewXClient(dis Discoery, mde SelectMode, op *Option) *XClient {
-	return &XClient{d: dis, mode: mde, opt: op, clients: make(map[string]*Client)}
+// 使用内置的负载均衡策略
+func NewXClient(dis Discoery, mde SelectMode, op *Option, opts ...XClientOption) *XClient {
+	b, err := NewBalancer(mde.String())
+	if err != nil {
+		b = unsupportedBalancer{mde}
+	}
+	return NewXClientWithBalancer(dis, b, op, opts...)
+}
+
+// 使用自定义的负载均衡策略，也可以通过 NewBalancer 按名字创建
+func NewXClientWithBalancer(dis Discoery, b Balancer, op *Option, opts ...XClientOption) *XClient {
+	xc := &XClient{
+		d:         dis,
+		balancer:  b,
+		opt:       op,
+		clients:   make(map[string]*Client),
+		stats:     make(map[string]*addrStat),
+		xopt:      defaultXClientOptions(),
+		breakers:  make(map[string]*breaker),
+		outliers:  make(map[string]*outlier),
+		latencies: make(map[string]*methodLatency),
+	}
+	for _, opt := range opts {
+		opt(&xc.xopt)
+	}
+	if xc.xopt.hedging != nil && len(xc.xopt.idempotent) == 0 {
+		xc.log().Warn("rpc xclient: hedging only applies to idempotent methods, declare them with WithIdempotent")
+	}
+	if xc.xopt.breaker != nil || xc.xopt.outlier != nil {
+		xc.debugName = xc.newDebugName()
+		RegisterDebugSection(xc.debugName, xc.debugInfo)
+	}
+	xc.watchCtx, xc.stopWatch = context.WithCancel(context.Background())
+	go xc.watch(xc.d.Watch(xc.watchCtx))
+	return xc
+}
+
+// 不支持的 SelectMode，每次选择都返回错误
+type unsupportedBalancer struct {
+	mode SelectMode
+}
+
+func (b unsupportedBalancer) Update([]Instance)                     {}
+func (b unsupportedBalancer) Feedback(string, time.Duration, error) {}
+func (b unsupportedBalancer) Pick(*PickInfo) (string, error) {
+	return "", fmt.Errorf("rpc dicovery: not support this select mode %v", b.mode)
+}
+
+// 日志使用 Option.Logger，与底层 Client 保持一致
+func (xc *XClient) log() *slog.Logger {
+	if xc.opt != nil && xc.opt.Logger != nil {
+		return xc.opt.Logger
+	}
+	return slog.Default()
+}
+
+// 设置从参数中提取路由键的钩子函数，ConsistentHashSelect 等需要路由键的策略使用
+func (xc *XClient) SetHashKeyFunc(fn HashKeyFunc) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.hashKey = fn
 }
 
 func (xc *XClient) Close() error {
+	xc.stopWatch()
+	if xc.debugName != "" {
+		UnregisterDebugSection(xc.debugName)
+	}
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 
@@ -61,27 +142,79 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 
 	if client == nil {
 		var err error
-		client, err = XDial(rpcAddr, xc.opt)
+		client, err = XDial(rpcAddr, xc.dialOption())
 		if err != nil {
-			return nil, err
+			xc.log().Warn("rpc xclient: dial error", "addr", rpcAddr, "err", err)
+			// 拨号失败时请求还没有发出，属于连接层面的错误，可以放心地换一个实例重试
+			if ErrorCode(err) != CodeUnavailable {
+				err = &Error{Code: CodeUnavailable, Msg: err.Error()}
+			}
+			return nil, &dialError{err: err}
 		}
 		xc.clients[rpcAddr] = client
 	}
 	return client, nil
 }
 
+// 拨号失败的错误，请求一定还没有发出，不幂等的方法也可以重试
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// 重试由 XClient 按失败模式完成，底层的 Client 不再重试
+func (xc *XClient) dialOption() *Option {
+	if xc.opt == nil || xc.opt.Retry == nil {
+		return xc.opt
+	}
+	opt := *xc.opt
+	opt.Retry = nil
+	return &opt
+}
+
 // 通过服务器地址拿到与该Server对应的client， 底层调用Client
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
+	if err := xc.breakerAcquire(rpcAddr); err != nil {
+		return err
+	}
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
+		xc.breakerRecord(ctx, rpcAddr, err)
 		return err
 	}
-	return client.Call(ctx, serviceMethod, args, replyv)
+	start := time.Now()
+	err = client.Call(ctx, serviceMethod, args, replyv)
+	latency := time.Since(start)
+	xc.observe(rpcAddr, latency, err)
+	xc.breakerRecord(ctx, rpcAddr, err)
+	xc.outlierRecord(ctx, rpcAddr, latency, err)
+	xc.observeMethod(serviceMethod, latency, err)
+	xc.balancer.Feedback(rpcAddr, latency, err)
+	return err
 }
 
-// 封装call，调用对应的负载均衡策略，并对外暴露
+// 封装call，调用对应的负载均衡策略，按失败模式处理错误，并对外暴露
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	// 底层的 Client 不再按 Option.Retry 重试，Failfast 时由 XClient 按重试策略换实例重试，开启了对冲时每一次尝试都可以对冲
+	failMode := xc.xopt.failMode
+	if failMode == Failfast && xc.opt != nil && xc.opt.Retry != nil {
+		failMode = Failover
+	}
+	if xc.xopt.hedging != nil && (failMode == Failfast || failMode == Failbackup) {
+		return xc.hedge(ctx, serviceMethod, args, replyv)
+	}
+	switch failMode {
+	case Failover:
+		return xc.failover(ctx, serviceMethod, args, replyv)
+	case Failtry:
+		return xc.failtry(ctx, serviceMethod, args, replyv)
+	case Failbackup:
+		return xc.failbackup(ctx, serviceMethod, args, replyv)
+	}
+
+	rpcAddr, err := xc.selectServer(ctx, serviceMethod, args, nil)
 
 	if err != nil {
 		return err
@@ -90,7 +223,237 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args interfac
 	return xc.call(rpcAddr, ctx, serviceMethod, args, replyv)
 }
 
-// 向所有服务端广播调用这个服务
+// 从服务发现拿到服务实例，有变化时先更新 balancer，再由 balancer 选择
+// balancer 中是所有的实例，只选择提供 serviceMethod 中服务并满足选择条件的实例
+// filter 不为空时只选择返回 true 的实例
+func (xc *XClient) selectServer(ctx context.Context, serviceMethod string, args interface{}, filter func(string) bool) (string, error) {
+	_, key, allow, err := xc.route(ctx, serviceMethod, args, filter)
+	if err != nil {
+		return "", err
+	}
+
+	rpcAddr, err := xc.balancer.Pick(&PickInfo{
+		Ctx:           ctx,
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Key:           key,
+		State:         xc,
+		Filter:        allow,
+	})
+	if err == ErrNoAvailable && filter == nil && xc.xopt.breaker != nil {
+		return "", ErrCircuitOpen
+	}
+	return rpcAddr, err
+}
+
+// 选择实例前的准备，selectServer 和需要调用多个实例的方法共用
+// 返回提供该服务并满足选择条件的实例、路由键和 allow
+// allow 在 filter 的基础上跳过不提供该服务的、不满足选择条件的、熔断器打开的、被离群检测摘除的和其他区域的地址
+func (xc *XClient) route(ctx context.Context, serviceMethod string, args interface{}, filter func(string) bool) ([]Instance, string, func(string) bool, error) {
+	instances, err := xc.d.GetInstances()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	provided, err := xc.providers(ctx, serviceMethod)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if len(provided) == 0 {
+		return nil, "", nil, ErrNoAvailable
+	}
+
+	xc.updateInstances(instances, false)
+
+	xc.mu.Lock()
+	key := xc.routingKey(ctx, serviceMethod, args)
+	// balancer 持有自己的锁时会调用 filter，这里先记下来，避免在 filter 中加锁
+	// 只允许这次拿到的实例，balancer 中的列表可能还没有跟上服务发现
+	ok := make(map[string]bool, len(provided))
+	for _, ins := range provided {
+		ok[ins.Addr] = true
+	}
+	if xc.xopt.breaker != nil || xc.xopt.outlier != nil {
+		now := time.Now()
+		xc.detectOutliers(now, len(instances))
+		for _, ins := range provided {
+			if !xc.breakerAllow(ins.Addr) || xc.ejected(ins.Addr, now) {
+				delete(ok, ins.Addr)
+			}
+		}
+	}
+	xc.mu.Unlock()
+	allow := func(addr string) bool {
+		return ok[addr] && (filter == nil || filter(addr))
+	}
+	if xc.xopt.locality != nil {
+		allow = xc.localityFilter(serviceMethod, provided, allow)
+	}
+	return provided, key, allow, nil
+}
+
+// serviceMethod 中的服务名，格式同服务端: "Service.Method"
+func serviceName(serviceMethod string) string {
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		return serviceMethod[:dot]
+	}
+	return serviceMethod
+}
+
+// 提供 serviceMethod 中服务并满足选择条件的所有实例地址，用于广播等需要调用多个实例的方法
+func (xc *XClient) servers(ctx context.Context, serviceMethod string) ([]string, error) {
+	instances, err := xc.providers(ctx, serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	return addrs(instances), nil
+}
+
+// 调用方需持有锁
+func (xc *XClient) routingKey(ctx context.Context, serviceMethod string, args interface{}) string {
+	if key, ok := HashKeyFromContext(ctx); ok {
+		return key
+	}
+	if xc.hashKey != nil {
+		if key := xc.hashKey(serviceMethod, args); key != "" {
+			return key
+		}
+	}
+	if k, ok := args.(HashKeyer); ok {
+		return k.HashKey()
+	}
+	return ""
+}
+
+// 服务列表变化时更新 balancer，关闭已经下线的实例的连接，返回新上线的实例地址
+// 订阅收到服务列表之前由调用时拿到的列表更新，之后只由订阅更新：
+// 调用时拿到的列表可能比订阅推送的旧，用它更新会把已经下线的实例加回来
+func (xc *XClient) updateInstances(instances []Instance, fromWatch bool) []string {
+	// balancer 选择时会通过 ConnState 获取 xc.mu，更新 balancer 时不能持有 xc.mu
+	var removed, added []string
+	xc.updateMu.Lock()
+	if fromWatch && len(instances) > 0 {
+		// 从注册中心拉取的服务发现在第一次刷新前推送的是空列表，这时还不能只依赖订阅
+		xc.watching = true
+	}
+	if fromWatch || !xc.watching {
+		removed, added = xc.applyInstances(instances)
+	}
+	xc.updateMu.Unlock()
+	if len(removed) > 0 {
+		xc.closeClients(removed)
+	}
+	return added
+}
+
+// 调用方需持有 updateMu
+func (xc *XClient) applyInstances(instances []Instance) (removed, added []string) {
+	if !xc.updated || !sameInstances(xc.instances, instances) {
+		xc.balancer.Update(instances)
+		removed = diffAddrs(xc.instances, instances)
+		added = diffAddrs(instances, xc.instances)
+		xc.instances = instances
+		xc.updated = true
+	}
+	return removed, added
+}
+
+// 订阅服务发现的变化，下线的实例立即关闭连接，新上线的实例提前建立连接
+// 订阅时收到的第一个列表是当前已有的实例，不提前建立连接
+func (xc *XClient) watch(ch <-chan []Instance) {
+	defer func() {
+		xc.updateMu.Lock()
+		xc.watching = false
+		xc.updateMu.Unlock()
+	}()
+	first := true
+	for instances := range ch {
+		added := xc.updateInstances(instances, true)
+		if !first {
+			for _, addr := range added {
+				go xc.prewarm(addr)
+			}
+		}
+		first = false
+	}
+}
+
+// 提前建立连接，拨号时不持有 xc.mu，避免阻塞其他调用
+func (xc *XClient) prewarm(rpcAddr string) {
+	client, err := XDial(rpcAddr, xc.dialOption())
+	if err != nil {
+		xc.log().Warn("rpc xclient: prewarm error", "addr", rpcAddr, "err", err)
+		return
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if c, ok := xc.clients[rpcAddr]; xc.watchCtx.Err() != nil || (ok && c.IsAvailable()) {
+		_ = client.Close()
+		return
+	} else if ok {
+		_ = c.Close()
+	}
+	xc.log().Debug("rpc xclient: prewarm client", "addr", rpcAddr)
+	xc.clients[rpcAddr] = client
+}
+
+// 在 a 中但不在 b 中的地址
+func diffAddrs(a, b []Instance) []string {
+	exist := make(map[string]bool, len(b))
+	for _, ins := range b {
+		exist[ins.Addr] = true
+	}
+	var diff []string
+	for _, ins := range a {
+		if !exist[ins.Addr] {
+			diff = append(diff, ins.Addr)
+		}
+	}
+	return diff
+}
+
+// 服务实例下线后关闭缓存的连接，并清理该地址的统计数据
+// 连接上还有在途的请求时，等它们结束或者超过 drainTimeout 后再关闭
+func (xc *XClient) closeClients(servers []string) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for _, addr := range servers {
+		if client, ok := xc.clients[addr]; ok {
+			xc.log().Info("rpc xclient: close client of removed server", "addr", addr, "pending", client.Pending())
+			delete(xc.clients, addr)
+			go drainClient(client)
+		}
+		delete(xc.stats, addr)
+		delete(xc.breakers, addr)
+		delete(xc.outliers, addr)
+	}
+}
+
+const (
+	drainTimeout  = 5 * time.Second
+	drainInterval = 10 * time.Millisecond
+)
+
+func drainClient(client *Client) {
+	deadline := time.Now().Add(drainTimeout)
+	for client.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainInterval)
+	}
+	_ = client.Close()
+}
+
+func sameInstances(a, b []Instance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 向提供这个服务的所有服务端广播调用
 // 代码一些并发相关的细节：
 // 1. 并发请求所有服务。需要使用互斥锁。
 // 2. 需要等所有服务都返回才能继续。需要使用 WaitGroup。
@@ -99,7 +462,7 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args interfac
 
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args interface{}, replyv interface{}) error {
 
-	servers, err := xc.d.GetAll()
+	servers, err := xc.servers(ctx, serviceMethod)
 
 	if err != nil {
 		return err
@@ -111,6 +474,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args int
 
 	replyDone := replyv == nil
 	contx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
@@ -0,0 +1,50 @@
+/*
+ * @Author: zzzzztw
+ * @Date: 2026-10-19 02:55:57
+ * @LastEditors: Do not edit
+ * @LastEditTime: 2026-10-19 02:55:57
+ * @FilePath: /TinyRpcByGo/xclient/xclient_test.go
+ */
+package xclient
+
+import (
+	"net"
+	"testing"
+	"time"
+	. "tinyrpc"
+)
+
+type Arith struct{}
+
+type Args struct{ A, B int }
+
+func (Arith) Sum(args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+// 等待 A 毫秒后返回 A + B
+func (Arith) Sleep(args Args, reply *int) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	*reply = args.A + args.B
+	return nil
+}
+
+// 没有服务监听的地址，拨号立即失败
+const deadAddr = "tcp@127.0.0.1:1"
+
+// 启动一个注册了 Arith 的服务端，返回可以交给 XDial 的地址
+func startServer(t *testing.T) string {
+	t.Helper()
+	server := NewServer()
+	if err := server.Register(Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String()
+}